@@ -0,0 +1,122 @@
+package entities
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDateFormat is returned when date is not in YYYY-MM-DD format
+var ErrDateFormat = errors.New("must be date in YYYY-MM-DD format")
+
+// Date is calendar date without time and time zone, such as date of birth.
+// It is written as YYYY-MM-DD in JSON, csv and SQL, so it never moves to the day before
+// when it passes through time zones. Zero Date is empty date
+type Date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+func NewDate(year int, month time.Month, day int) Date {
+	return Date{Year: year, Month: month, Day: day}
+}
+
+// DateOf returns date of t in its location
+func DateOf(t time.Time) Date {
+	year, month, day := t.Date()
+	return Date{Year: year, Month: month, Day: day}
+}
+
+// Today returns current date in UTC
+func Today() Date {
+	return DateOf(time.Now().UTC())
+}
+
+// ParseDate parses date in YYYY-MM-DD format
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return Date{}, ErrDateFormat
+	}
+	return DateOf(t), nil
+}
+
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+func (d Date) IsZero() bool {
+	return d == Date{}
+}
+
+// Time returns midnight of the date in UTC
+func (d Date) Time() time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, time.UTC)
+}
+
+func (d Date) Before(other Date) bool {
+	return d.Time().Before(other.Time())
+}
+
+func (d Date) After(other Date) bool {
+	return d.Time().After(other.Time())
+}
+
+// Age returns full years passed from d to on, person born on 29 February becomes older on 1 March
+func (d Date) Age(on Date) int {
+	age := on.Year - d.Year
+	if on.Month < d.Month || (on.Month == d.Month && on.Day < d.Day) {
+		age--
+	}
+	return age
+}
+
+// MarshalText is used by JSON too, empty date is written as empty string
+func (d Date) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Date) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*d = Date{}
+		return nil
+	}
+
+	date, err := ParseDate(string(text))
+	if err != nil {
+		return err
+	}
+	*d = date
+	return nil
+}
+
+// Value writes date to database as YYYY-MM-DD text, empty date is NULL
+func (d Date) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	return d.String(), nil
+}
+
+// Scan reads date from DATE or TIMESTAMP column or from YYYY-MM-DD text
+func (d *Date) Scan(src any) error {
+	switch value := src.(type) {
+	case nil:
+		*d = Date{}
+		return nil
+	case time.Time:
+		*d = DateOf(value)
+		return nil
+	case string:
+		return d.UnmarshalText([]byte(value))
+	case []byte:
+		return d.UnmarshalText(value)
+	default:
+		return fmt.Errorf("can't scan %T into date", src)
+	}
+}
@@ -0,0 +1,106 @@
+package entities
+
+import "time"
+
+type Patient struct {
+	Id           uint       `json:"id"`
+	Name         string     `json:"name"`
+	LastName     string     `json:"last_name"`
+	DateOfBirth  Date       `json:"date_of_birth"`
+	BloodType    uint       `json:"blood_type"`
+	RhFactor     string     `json:"rh_factor"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	DeleteReason string     `json:"delete_reason,omitempty"`
+}
+
+// PatientDeletion is request to mark patient as deleted
+type PatientDeletion struct {
+	Id     uint   `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// PatientUpdate contains fields which have to be changed, nil fields stay as they are
+type PatientUpdate struct {
+	Id          uint    `json:"id"`
+	Name        *string `json:"name,omitempty"`
+	LastName    *string `json:"last_name,omitempty"`
+	DateOfBirth *Date   `json:"date_of_birth,omitempty"`
+	BloodType   *uint   `json:"blood_type,omitempty"`
+	RhFactor    *string `json:"rh_factor,omitempty"`
+}
+
+// PatientQuery is filter, sorting and page of patients list
+type PatientQuery struct {
+	LastName  string `json:"last_name,omitempty"`
+	BloodType uint   `json:"blood_type,omitempty"`
+	RhFactor  string `json:"rh_factor,omitempty"`
+	//date of birth range, both ends are included
+	BornFrom *Date `json:"born_from,omitempty"`
+	BornTo   *Date `json:"born_to,omitempty"`
+	//id, last_name or date_of_birth
+	Sort           string `json:"sort"`
+	Desc           bool   `json:"desc,omitempty"`
+	Limit          int    `json:"limit"`
+	Cursor         string `json:"cursor,omitempty"`
+	IncludeDeleted bool   `json:"include_deleted,omitempty"`
+}
+
+// PatientPage is page of patients list, next page is requested with NextCursor
+type PatientPage struct {
+	Patients   []Patient `json:"patients"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// PatientSearch is request to find patients by name and last name
+type PatientSearch struct {
+	Query string `json:"q"`
+	Limit int    `json:"limit"`
+}
+
+// PatientMatch is found patient, the higher score the closer patient's name to the query
+type PatientMatch struct {
+	Patient Patient `json:"patient"`
+	Score   float64 `json:"score"`
+}
+
+type SearchResult struct {
+	Matches []PatientMatch `json:"matches"`
+}
+
+// BatchItemResult is result of creating one patient of the batch,
+// status of created patient is got by RequestId as status of single create
+type BatchItemResult struct {
+	Index     int          `json:"index"`
+	RequestId string       `json:"request_id,omitempty"`
+	Patient   *Patient     `json:"patient,omitempty"`
+	Code      string       `json:"code,omitempty"`
+	Err       string       `json:"err,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+// PatientIds is request to get several patients at once
+type PatientIds struct {
+	Ids            []uint `json:"ids"`
+	IncludeDeleted bool   `json:"include_deleted,omitempty"`
+}
+
+// PatientsByIds contains found patients and ids which are not found
+type PatientsByIds struct {
+	Patients []Patient `json:"patients"`
+	NotFound []uint    `json:"not_found"`
+}
+
+const (
+	RequestPending   = "pending"
+	RequestSucceeded = "succeeded"
+	RequestFailed    = "failed"
+)
+
+// RequestStatus is state of asynchronous create request,
+// PatientId is set when request succeeded and Err when it failed
+type RequestStatus struct {
+	RequestId string `json:"request_id"`
+	Status    string `json:"status"`
+	PatientId uint   `json:"patient_id,omitempty"`
+	Err       string `json:"err,omitempty"`
+}
@@ -0,0 +1,129 @@
+package entities
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLen = 100
+
+	RhPositive = "positive"
+	RhNegative = "negative"
+)
+
+// nobody born earlier is expected to be a patient
+var minDateOfBirth = NewDate(1900, time.January, 1)
+
+// FieldError tells which field of the patient is invalid and why
+type FieldError struct {
+	Field string `json:"field"`
+	Err   string `json:"err"`
+}
+
+// ValidationError contains every invalid field of the patient
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	fields := make([]string, len(e))
+	for i, fieldErr := range e {
+		fields[i] = fieldErr.Field + ": " + fieldErr.Err
+	}
+	return "invalid patient: " + strings.Join(fields, ", ")
+}
+
+// Validate checks every field of the patient, all fields are required
+func (p Patient) Validate() error {
+	var errs ValidationError
+	errs.check("name", validateName(p.Name))
+	errs.check("last_name", validateName(p.LastName))
+	errs.check("date_of_birth", validateDateOfBirth(p.DateOfBirth))
+	errs.check("blood_type", validateBloodType(p.BloodType))
+	errs.check("rh_factor", validateRhFactor(p.RhFactor))
+	return errs.orNil()
+}
+
+// Validate checks only fields which are changed
+func (u PatientUpdate) Validate() error {
+	var errs ValidationError
+	if u.Name != nil {
+		errs.check("name", validateName(*u.Name))
+	}
+	if u.LastName != nil {
+		errs.check("last_name", validateName(*u.LastName))
+	}
+	if u.DateOfBirth != nil {
+		errs.check("date_of_birth", validateDateOfBirth(*u.DateOfBirth))
+	}
+	if u.BloodType != nil {
+		errs.check("blood_type", validateBloodType(*u.BloodType))
+	}
+	if u.RhFactor != nil {
+		errs.check("rh_factor", validateRhFactor(*u.RhFactor))
+	}
+	return errs.orNil()
+}
+
+func (e *ValidationError) check(field string, msg string) {
+	if msg != "" {
+		*e = append(*e, FieldError{Field: field, Err: msg})
+	}
+}
+
+// orNil returns nil interface when there are no errors, typed nil would be non-nil error
+func (e ValidationError) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func validateName(name string) string {
+	if name == "" {
+		return "is required"
+	}
+	if utf8.RuneCountInString(name) > maxNameLen {
+		return fmt.Sprintf("must be at most %d characters", maxNameLen)
+	}
+
+	first, _ := utf8.DecodeRuneInString(name)
+	if !unicode.IsLetter(first) {
+		return "must start with a letter"
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && r != ' ' && r != '-' && r != '\'' {
+			return "must contain only letters, spaces, hyphens and apostrophes"
+		}
+	}
+	return ""
+}
+
+func validateDateOfBirth(date Date) string {
+	if date.IsZero() {
+		return "is required"
+	}
+	if date.Before(minDateOfBirth) {
+		return "must not be earlier than " + minDateOfBirth.String()
+	}
+	if date.After(Today()) {
+		return "must not be in the future"
+	}
+	return ""
+}
+
+func validateBloodType(bloodType uint) string {
+	if bloodType < 1 || bloodType > 4 {
+		return "must be from 1 to 4"
+	}
+	return ""
+}
+
+func validateRhFactor(rhFactor string) string {
+	if rhFactor != RhPositive && rhFactor != RhNegative {
+		return fmt.Sprintf("must be %s or %s", RhPositive, RhNegative)
+	}
+	return ""
+}
@@ -0,0 +1,5 @@
+module contract
+
+go 1.21.1
+
+require google.golang.org/protobuf v1.31.0
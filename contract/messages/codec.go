@@ -0,0 +1,79 @@
+package messages
+
+import (
+	"contract/schema"
+	"encoding/json"
+	"fmt"
+)
+
+// encodings of payloads, every service chooses its own in config
+const (
+	EncodingJson     = "json"
+	EncodingProtobuf = "protobuf"
+)
+
+// content types of payloads, they are sent in envelope
+const (
+	ContentTypeJson     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// CheckEncoding returns error if encoding is unknown
+func CheckEncoding(encoding string) error {
+	switch encoding {
+	case EncodingJson, EncodingProtobuf:
+		return nil
+	}
+	return fmt.Errorf("unknown encoding %s, supported encodings are %s and %s", encoding, EncodingJson, EncodingProtobuf)
+}
+
+// ContentType returns content type of payloads which have schema in the encoding
+func ContentType(encoding string) string {
+	if encoding == EncodingProtobuf {
+		return ContentTypeProtobuf
+	}
+	return ContentTypeJson
+}
+
+// Marshal encodes v in the encoding, value without protobuf schema is always encoded in JSON.
+// Content type of data goes to envelope, so receiver decodes it whatever encoding it uses itself
+func Marshal(encoding string, v any) (data []byte, contentType string, err error) {
+	if encoding == EncodingProtobuf {
+		if data, ok := marshalProto(v); ok {
+			return data, ContentTypeProtobuf, nil
+		}
+	}
+
+	data, err = json.Marshal(v)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode %T: %w", v, err)
+	}
+	return data, ContentTypeJson, nil
+}
+
+// Unmarshal decodes data of the content type into v
+func Unmarshal(contentType string, data []byte, v any) error {
+	switch contentType {
+	case ContentTypeJson:
+		return json.Unmarshal(data, v)
+	case ContentTypeProtobuf:
+		return unmarshalProto(data, v)
+	}
+	return fmt.Errorf("unsupported content type %s", contentType)
+}
+
+// RegisterSchemas checks protobuf schemas of this build against registry in dir and registers new versions,
+// service must not start if any schema is incompatible
+func RegisterSchemas(dir string) error {
+	registry, err := schema.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range schemas {
+		if _, err := registry.Register(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package messages
+
+import (
+	"contract/entities"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testPatient() entities.Patient {
+	deletedAt := time.Date(2023, time.May, 1, 12, 30, 0, 0, time.UTC)
+	return entities.Patient{
+		Id:           42,
+		Name:         "John",
+		LastName:     "Doe",
+		DateOfBirth:  entities.NewDate(2000, time.January, 1),
+		BloodType:    1,
+		RhFactor:     "positive",
+		DeletedAt:    &deletedAt,
+		DeleteReason: "duplicate",
+	}
+}
+
+func TestMarshalReplyRoundTrip(t *testing.T) {
+	for _, encoding := range []string{EncodingJson, EncodingProtobuf} {
+		t.Run(encoding, func(t *testing.T) {
+			patient := testPatient()
+
+			data, contentType, err := Marshal(encoding, patient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if contentType != ContentType(encoding) {
+				t.Fatalf("got content type %s, want %s", contentType, ContentType(encoding))
+			}
+
+			var got entities.Patient
+			replyErr, err := DecodeReply(contentType, EncodeReply(contentType, data), &got)
+			if err != nil || replyErr != nil {
+				t.Fatalf("failed to decode reply: %v, %v", err, replyErr)
+			}
+			if !reflect.DeepEqual(got, patient) {
+				t.Fatalf("got %+v, want %+v", got, patient)
+			}
+		})
+	}
+}
+
+func TestMarshalRequestStatus(t *testing.T) {
+	for _, encoding := range []string{EncodingJson, EncodingProtobuf} {
+		t.Run(encoding, func(t *testing.T) {
+			status := entities.RequestStatus{RequestId: "id", Status: entities.RequestFailed, Err: "rejected"}
+
+			data, contentType, err := Marshal(encoding, &status)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got entities.RequestStatus
+			if err := Unmarshal(contentType, data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != status {
+				t.Fatalf("got %+v, want %+v", got, status)
+			}
+		})
+	}
+}
+
+// value without protobuf schema is sent in JSON whatever encoding is chosen
+func TestMarshalWithoutSchemaIsJson(t *testing.T) {
+	page := entities.PatientPage{Patients: []entities.Patient{testPatient()}, NextCursor: "next"}
+
+	data, contentType, err := Marshal(EncodingProtobuf, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != ContentTypeJson {
+		t.Fatalf("got content type %s, want %s", contentType, ContentTypeJson)
+	}
+
+	var got entities.PatientPage
+	replyErr, err := DecodeReply(contentType, EncodeReply(contentType, data), &got)
+	if err != nil || replyErr != nil {
+		t.Fatalf("failed to decode reply: %v, %v", err, replyErr)
+	}
+	if !reflect.DeepEqual(got, page) {
+		t.Fatalf("got %+v, want %+v", got, page)
+	}
+}
+
+func TestDecodeReplyError(t *testing.T) {
+	for _, contentType := range []string{ContentTypeJson, ContentTypeProtobuf} {
+		t.Run(contentType, func(t *testing.T) {
+			sent := Error{Code: CodeValidation, Err: ErrInvalidPatient, Fields: []entities.FieldError{
+				{Field: "blood_type", Err: "must be from 1 to 4"},
+				{Field: "name", Err: "is required"},
+			}}
+
+			var patient entities.Patient
+			replyErr, err := DecodeReply(contentType, EncodeError(contentType, sent), &patient)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replyErr == nil || !reflect.DeepEqual(*replyErr, sent) {
+				t.Fatalf("got error %+v, want %+v", replyErr, sent)
+			}
+		})
+	}
+}
+
+func TestDecodeReplyUnknownContentType(t *testing.T) {
+	var patient entities.Patient
+	if _, err := DecodeReply("text/plain", []byte("{}"), &patient); err == nil {
+		t.Fatal("expected error for unknown content type")
+	}
+}
+
+// field added by newer peer is skipped by reader which doesn't know it
+func TestUnmarshalProtoSkipsUnknownFields(t *testing.T) {
+	patient := testPatient()
+	patient.DeletedAt, patient.DeleteReason = nil, ""
+
+	data := appendPatient(nil, patient)
+	data = appendString(data, 100, "unknown")
+	data = appendUint(data, 101, 7)
+
+	var got entities.Patient
+	if err := Unmarshal(ContentTypeProtobuf, data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, patient) {
+		t.Fatalf("got %+v, want %+v", got, patient)
+	}
+}
@@ -0,0 +1,176 @@
+package messages
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// headers of envelope, every message carries them
+const (
+	HeaderType    = "type"
+	HeaderVersion = "version"
+	//id of the request, reply has id of the request it answers.
+	//It differs from message key when request is keyed by another request to get into its partition
+	HeaderRequestId = "request-id"
+	HeaderTimestamp = "timestamp"
+	HeaderSource    = "source"
+	//time after which nobody waits for the reply, request without deadline is never late
+	HeaderDeadline = "deadline"
+	//encoding of the payload, message without it is JSON
+	HeaderContentType = "content-type"
+)
+
+// types of messages
+const (
+	TypeCreatePatient  = "createPatient"
+	TypeCreatePatients = "createPatients"
+	TypeGetPatient     = "patientId"
+	TypeGetPatients    = "patientIds"
+	TypeUpdatePatient  = "updatePatient"
+	TypeDeletePatient  = "deletePatient"
+	TypeRestorePatient = "restorePatient"
+	TypeListPatients   = "listPatients"
+	TypeSearchPatients = "searchPatients"
+	//status of create, it is sent to TopicCreatePatient after the create
+	TypeRequestStatus = "requestStatus"
+	//status of row of batch, it is sent to TopicCreatePatients after the batch
+	TypeBatchItemStatus = "batchItemStatus"
+	TypeReply           = "reply"
+)
+
+// services which send messages
+const (
+	SourceServer   = "server"
+	SourceDbwriter = "dbwriter"
+)
+
+// versions are the newest payload versions of every type this code understands,
+// message of newer version comes from newer peer and is rejected
+var versions = map[string]int{
+	TypeCreatePatient:   1,
+	TypeCreatePatients:  1,
+	TypeGetPatient:      1,
+	TypeGetPatients:     1,
+	TypeUpdatePatient:   1,
+	TypeDeletePatient:   1,
+	TypeRestorePatient:  1,
+	TypeListPatients:    1,
+	TypeSearchPatients:  1,
+	TypeRequestStatus:   1,
+	TypeBatchItemStatus: 1,
+	TypeReply:           1,
+}
+
+// topics of request types, status request shares topic with its create to be handled after it
+var topics = map[string]string{
+	TypeCreatePatient:   TopicCreatePatient,
+	TypeCreatePatients:  TopicCreatePatients,
+	TypeGetPatient:      TopicPatientId,
+	TypeGetPatients:     TopicPatientIds,
+	TypeUpdatePatient:   TopicUpdatePatient,
+	TypeDeletePatient:   TopicDeletePatient,
+	TypeRestorePatient:  TopicRestorePatient,
+	TypeListPatients:    TopicListPatients,
+	TypeSearchPatients:  TopicSearchPatients,
+	TypeRequestStatus:   TopicCreatePatient,
+	TypeBatchItemStatus: TopicCreatePatients,
+}
+
+// Topic returns topic requests of the type are sent to
+func Topic(msgType string) string {
+	return topics[msgType]
+}
+
+// Envelope describes message, it is carried in kafka headers next to the payload
+type Envelope struct {
+	Type      string
+	Version   int
+	RequestId string
+	Timestamp time.Time
+	Source    string
+	Deadline  time.Time
+	//ContentTypeJson or ContentTypeProtobuf
+	ContentType string
+}
+
+// NewEnvelope makes envelope of the newest version of the type sent now, payload is JSON
+// unless content type is changed
+func NewEnvelope(msgType string, requestId string, source string) Envelope {
+	return Envelope{
+		Type:        msgType,
+		Version:     versions[msgType],
+		RequestId:   requestId,
+		Timestamp:   time.Now().UTC(),
+		Source:      source,
+		ContentType: ContentTypeJson,
+	}
+}
+
+// Headers returns headers of the envelope, deadline is skipped if it is not set
+func (e Envelope) Headers() map[string]string {
+	headers := map[string]string{
+		HeaderType:        e.Type,
+		HeaderVersion:     strconv.Itoa(e.Version),
+		HeaderRequestId:   e.RequestId,
+		HeaderTimestamp:   e.Timestamp.Format(time.RFC3339Nano),
+		HeaderSource:      e.Source,
+		HeaderContentType: e.ContentType,
+	}
+	if !e.Deadline.IsZero() {
+		headers[HeaderDeadline] = e.Deadline.UTC().Format(time.RFC3339Nano)
+	}
+	return headers
+}
+
+// Late tells if nobody waits for the reply anymore
+func (e Envelope) Late(now time.Time) bool {
+	return !e.Deadline.IsZero() && now.After(e.Deadline)
+}
+
+// Check returns error if type of the message is unknown, its version is newer than this code understands
+// or its payload has unknown encoding
+func (e Envelope) Check() error {
+	newest, ok := versions[e.Type]
+	if !ok {
+		return fmt.Errorf("unknown message type %q", e.Type)
+	}
+	if e.Version < 1 || e.Version > newest {
+		return fmt.Errorf("unsupported version %d of %s message, supported versions are 1..%d", e.Version, e.Type, newest)
+	}
+	if e.ContentType != ContentTypeJson && e.ContentType != ContentTypeProtobuf {
+		return fmt.Errorf("unsupported content type %s", e.ContentType)
+	}
+	return nil
+}
+
+// ReadEnvelope reads envelope from headers got by header function,
+// missing header is empty string
+func ReadEnvelope(header func(key string) string) (Envelope, error) {
+	e := Envelope{
+		Type:        header(HeaderType),
+		RequestId:   header(HeaderRequestId),
+		Source:      header(HeaderSource),
+		ContentType: header(HeaderContentType),
+	}
+	if e.ContentType == "" {
+		e.ContentType = ContentTypeJson
+	}
+
+	var err error
+	if e.Version, err = strconv.Atoi(header(HeaderVersion)); err != nil {
+		return e, fmt.Errorf("invalid %s header", HeaderVersion)
+	}
+
+	if e.Timestamp, err = time.Parse(time.RFC3339Nano, header(HeaderTimestamp)); err != nil {
+		return e, fmt.Errorf("invalid %s header", HeaderTimestamp)
+	}
+
+	if deadline := header(HeaderDeadline); deadline != "" {
+		if e.Deadline, err = time.Parse(time.RFC3339Nano, deadline); err != nil {
+			return e, fmt.Errorf("invalid %s header", HeaderDeadline)
+		}
+	}
+
+	return e, nil
+}
@@ -0,0 +1,342 @@
+package messages
+
+import (
+	"contract/entities"
+	"contract/schema"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field numbers of protobuf payloads, they are registered in schema registry
+// and must never be reused for another field
+const (
+	patientId           protowire.Number = 1
+	patientName         protowire.Number = 2
+	patientLastName     protowire.Number = 3
+	patientDateOfBirth  protowire.Number = 4
+	patientBloodType    protowire.Number = 5
+	patientRhFactor     protowire.Number = 6
+	patientDeletedAt    protowire.Number = 7
+	patientDeleteReason protowire.Number = 8
+
+	statusRequestId protowire.Number = 1
+	statusStatus    protowire.Number = 2
+	statusPatientId protowire.Number = 3
+	statusErr       protowire.Number = 4
+
+	replyData  protowire.Number = 1
+	replyError protowire.Number = 2
+
+	errorCode   protowire.Number = 1
+	errorErr    protowire.Number = 2
+	errorFields protowire.Number = 3
+
+	fieldErrorField protowire.Number = 1
+	fieldErrorErr   protowire.Number = 2
+)
+
+// schemas describe payloads encoded by this file, the rest of payloads are always JSON
+var schemas = []schema.Schema{
+	{Subject: "Patient", Fields: []schema.Field{
+		{Number: int(patientId), Name: "id", Type: "uint64"},
+		{Number: int(patientName), Name: "name", Type: "string"},
+		{Number: int(patientLastName), Name: "last_name", Type: "string"},
+		//YYYY-MM-DD
+		{Number: int(patientDateOfBirth), Name: "date_of_birth", Type: "string"},
+		{Number: int(patientBloodType), Name: "blood_type", Type: "uint64"},
+		{Number: int(patientRhFactor), Name: "rh_factor", Type: "string"},
+		//unix time in nanoseconds
+		{Number: int(patientDeletedAt), Name: "deleted_at", Type: "int64"},
+		{Number: int(patientDeleteReason), Name: "delete_reason", Type: "string"},
+	}},
+	{Subject: "RequestStatus", Fields: []schema.Field{
+		{Number: int(statusRequestId), Name: "request_id", Type: "string"},
+		{Number: int(statusStatus), Name: "status", Type: "string"},
+		{Number: int(statusPatientId), Name: "patient_id", Type: "uint64"},
+		{Number: int(statusErr), Name: "err", Type: "string"},
+	}},
+	{Subject: "Reply", Fields: []schema.Field{
+		//payload encoded in protobuf too
+		{Number: int(replyData), Name: "data", Type: "bytes"},
+		{Number: int(replyError), Name: "error", Type: "Error"},
+	}},
+	{Subject: "Error", Fields: []schema.Field{
+		{Number: int(errorCode), Name: "code", Type: "string"},
+		{Number: int(errorErr), Name: "err", Type: "string"},
+		{Number: int(errorFields), Name: "fields", Type: "FieldError", Repeated: true},
+	}},
+	{Subject: "FieldError", Fields: []schema.Field{
+		{Number: int(fieldErrorField), Name: "field", Type: "string"},
+		{Number: int(fieldErrorErr), Name: "err", Type: "string"},
+	}},
+}
+
+// marshalProto encodes v if it has protobuf schema
+func marshalProto(v any) ([]byte, bool) {
+	switch v := v.(type) {
+	case entities.Patient:
+		return appendPatient(nil, v), true
+	case *entities.Patient:
+		return appendPatient(nil, *v), true
+	case entities.RequestStatus:
+		return appendRequestStatus(nil, v), true
+	case *entities.RequestStatus:
+		return appendRequestStatus(nil, *v), true
+	}
+	return nil, false
+}
+
+func unmarshalProto(data []byte, v any) error {
+	switch v := v.(type) {
+	case *entities.Patient:
+		return consumePatient(data, v)
+	case *entities.RequestStatus:
+		return consumeRequestStatus(data, v)
+	}
+	return fmt.Errorf("%T has no protobuf schema", v)
+}
+
+func appendPatient(b []byte, p entities.Patient) []byte {
+	b = appendUint(b, patientId, uint64(p.Id))
+	b = appendString(b, patientName, p.Name)
+	b = appendString(b, patientLastName, p.LastName)
+	b = appendString(b, patientDateOfBirth, p.DateOfBirth.String())
+	b = appendUint(b, patientBloodType, uint64(p.BloodType))
+	b = appendString(b, patientRhFactor, p.RhFactor)
+	if p.DeletedAt != nil {
+		b = protowire.AppendTag(b, patientDeletedAt, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(p.DeletedAt.UnixNano()))
+	}
+	b = appendString(b, patientDeleteReason, p.DeleteReason)
+	return b
+}
+
+func consumePatient(b []byte, p *entities.Patient) error {
+	var dateOfBirth string
+	var id, bloodType uint64
+
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case patientId:
+			return consumeUint(typ, b, &id)
+		case patientName:
+			return consumeString(typ, b, &p.Name)
+		case patientLastName:
+			return consumeString(typ, b, &p.LastName)
+		case patientDateOfBirth:
+			return consumeString(typ, b, &dateOfBirth)
+		case patientBloodType:
+			return consumeUint(typ, b, &bloodType)
+		case patientRhFactor:
+			return consumeString(typ, b, &p.RhFactor)
+		case patientDeletedAt:
+			var deletedAt uint64
+			n := consumeUint(typ, b, &deletedAt)
+			if n > 0 {
+				t := time.Unix(0, int64(deletedAt)).UTC()
+				p.DeletedAt = &t
+			}
+			return n
+		case patientDeleteReason:
+			return consumeString(typ, b, &p.DeleteReason)
+		}
+		return 0
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decode patient: %w", err)
+	}
+
+	p.Id, p.BloodType = uint(id), uint(bloodType)
+	if err := p.DateOfBirth.UnmarshalText([]byte(dateOfBirth)); err != nil {
+		return fmt.Errorf("failed to decode patient: %w", err)
+	}
+	return nil
+}
+
+func appendRequestStatus(b []byte, s entities.RequestStatus) []byte {
+	b = appendString(b, statusRequestId, s.RequestId)
+	b = appendString(b, statusStatus, s.Status)
+	b = appendUint(b, statusPatientId, uint64(s.PatientId))
+	b = appendString(b, statusErr, s.Err)
+	return b
+}
+
+func consumeRequestStatus(b []byte, s *entities.RequestStatus) error {
+	var patientId uint64
+
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case statusRequestId:
+			return consumeString(typ, b, &s.RequestId)
+		case statusStatus:
+			return consumeString(typ, b, &s.Status)
+		case statusPatientId:
+			return consumeUint(typ, b, &patientId)
+		case statusErr:
+			return consumeString(typ, b, &s.Err)
+		}
+		return 0
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decode request status: %w", err)
+	}
+
+	s.PatientId = uint(patientId)
+	return nil
+}
+
+func appendReply(b []byte, data []byte, replyErr *Error) []byte {
+	if data != nil {
+		b = protowire.AppendTag(b, replyData, protowire.BytesType)
+		b = protowire.AppendBytes(b, data)
+	}
+	if replyErr != nil {
+		b = protowire.AppendTag(b, replyError, protowire.BytesType)
+		b = protowire.AppendBytes(b, appendError(nil, *replyErr))
+	}
+	return b
+}
+
+func consumeReply(b []byte) (data []byte, replyErr *Error, err error) {
+	err = consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		if typ != protowire.BytesType {
+			return 0
+		}
+
+		switch num {
+		case replyData:
+			v, n := protowire.ConsumeBytes(b)
+			data = v
+			return n
+		case replyError:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+			replyErr = &Error{}
+			if err := consumeError(v, replyErr); err != nil {
+				return -1
+			}
+			return n
+		}
+		return 0
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode reply: %w", err)
+	}
+	return data, replyErr, nil
+}
+
+func appendError(b []byte, e Error) []byte {
+	b = appendString(b, errorCode, e.Code)
+	b = appendString(b, errorErr, e.Err)
+	for _, f := range e.Fields {
+		var field []byte
+		field = appendString(field, fieldErrorField, f.Field)
+		field = appendString(field, fieldErrorErr, f.Err)
+
+		b = protowire.AppendTag(b, errorFields, protowire.BytesType)
+		b = protowire.AppendBytes(b, field)
+	}
+	return b
+}
+
+func consumeError(b []byte, e *Error) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) int {
+		switch num {
+		case errorCode:
+			return consumeString(typ, b, &e.Code)
+		case errorErr:
+			return consumeString(typ, b, &e.Err)
+		case errorFields:
+			if typ != protowire.BytesType {
+				return 0
+			}
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n
+			}
+
+			var f entities.FieldError
+			err := consumeFields(v, func(num protowire.Number, typ protowire.Type, b []byte) int {
+				switch num {
+				case fieldErrorField:
+					return consumeString(typ, b, &f.Field)
+				case fieldErrorErr:
+					return consumeString(typ, b, &f.Err)
+				}
+				return 0
+			})
+			if err != nil {
+				return -1
+			}
+			e.Fields = append(e.Fields, f)
+			return n
+		}
+		return 0
+	})
+}
+
+// consumeFields calls field for every field of message, field returns length of the value it consumed.
+// Zero length means the field is unknown, it comes from newer schema and is skipped
+func consumeFields(b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) int) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n = field(num, typ, b)
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// appendString skips empty string, it is default value of protobuf
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendUint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// consumeString and consumeUint treat field of another wire type as unknown
+func consumeString(typ protowire.Type, b []byte, v *string) int {
+	if typ != protowire.BytesType {
+		return 0
+	}
+	s, n := protowire.ConsumeString(b)
+	if n >= 0 {
+		*v = s
+	}
+	return n
+}
+
+func consumeUint(typ protowire.Type, b []byte, v *uint64) int {
+	if typ != protowire.VarintType {
+		return 0
+	}
+	u, n := protowire.ConsumeVarint(b)
+	if n >= 0 {
+		*v = u
+	}
+	return n
+}
@@ -0,0 +1,89 @@
+package messages
+
+import (
+	"contract/entities"
+	"encoding/json"
+	"fmt"
+)
+
+// codes of errors, server chooses HTTP status by the code
+const (
+	CodeNotFound    = "NOT_FOUND"
+	CodeValidation  = "VALIDATION_FAILED"
+	CodeConflict    = "CONFLICT"
+	CodeInternal    = "INTERNAL"
+	CodeTimeout     = "TIMEOUT"
+	CodeUnavailable = "UNAVAILABLE"
+)
+
+// ErrPatientNotExist is sent when patient with requested id is not found
+const ErrPatientNotExist = "patient is not exist"
+
+// ErrRequestNotExist is sent when status of asynchronous request is not found
+const ErrRequestNotExist = "request is not exist"
+
+// ErrIdempotencyKeyReused is sent when idempotency key is repeated with another request
+const ErrIdempotencyKeyReused = "idempotency key is already used with another request"
+
+// ErrInvalidPatient is sent when patient's fields are invalid, the fields are listed in Fields
+const ErrInvalidPatient = "invalid patient"
+
+type Error struct {
+	Code   string                `json:"code"`
+	Err    string                `json:"err"`
+	Fields []entities.FieldError `json:"fields,omitempty"`
+}
+
+func NewError(code string, msg string) Error {
+	return Error{Code: code, Err: msg}
+}
+
+// Reply is message dbwriter answers with, it contains either data or error
+type Reply struct {
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error *Error          `json:"error,omitempty"`
+}
+
+// EncodeReply makes reply with data which is already encoded in the content type,
+// reply itself is encoded in the same content type
+func EncodeReply(contentType string, data []byte) []byte {
+	if contentType == ContentTypeProtobuf {
+		return appendReply(nil, data, nil)
+	}
+	value, _ := json.Marshal(Reply{Data: data})
+	return value
+}
+
+func EncodeError(contentType string, err Error) []byte {
+	if contentType == ContentTypeProtobuf {
+		return appendReply(nil, nil, &err)
+	}
+	value, _ := json.Marshal(Reply{Error: &err})
+	return value
+}
+
+// DecodeReply decodes data of reply of the content type into v, error sent by dbwriter is returned as replyErr
+func DecodeReply(contentType string, value []byte, v any) (replyErr *Error, err error) {
+	var reply Reply
+	switch contentType {
+	case ContentTypeJson:
+		if err := json.Unmarshal(value, &reply); err != nil {
+			return nil, fmt.Errorf("failed to decode reply: %w", err)
+		}
+	case ContentTypeProtobuf:
+		if reply.Data, reply.Error, err = consumeReply(value); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %s", contentType)
+	}
+
+	if reply.Error != nil {
+		return reply.Error, nil
+	}
+
+	if err := Unmarshal(contentType, reply.Data, v); err != nil {
+		return nil, fmt.Errorf("failed to decode reply data: %w", err)
+	}
+	return nil, nil
+}
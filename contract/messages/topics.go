@@ -0,0 +1,38 @@
+// Package messages describes kafka messages server and dbwriter exchange:
+// topics, headers and reply envelope
+package messages
+
+// topics of requests sent by server to dbwriter
+const (
+	TopicCreatePatient  = "createPatient"
+	TopicCreatePatients = "createPatients"
+	TopicPatientId      = "patientId"
+	TopicPatientIds     = "patientIds"
+	TopicUpdatePatient  = "updatePatient"
+	TopicDeletePatient  = "deletePatient"
+	TopicRestorePatient = "restorePatient"
+	TopicListPatients   = "listPatients"
+	TopicSearchPatients = "searchPatients"
+)
+
+// TopicPatientInfo is topic of replies, server instance reads replies from its own TopicPatientInfo.<instance id>
+const TopicPatientInfo = "patientInfo"
+
+// TopicDbwriter is topic of requests forwarded between dbwriter instances,
+// instance reads requests forwarded to it from its own TopicDbwriter.<instance id>
+const TopicDbwriter = "dbwriter"
+
+// headers of requests, headers of envelope are in envelope.go
+const (
+	//topic where reply is sent
+	HeaderReplyTo = "reply-to"
+	//create without reply, result is kept as request status
+	HeaderAsync = "async"
+	//deleted patient is found too
+	HeaderIncludeDeleted = "include-deleted"
+	//retry with the same key gets result of the first request
+	HeaderIdempotencyKey = "idempotency-key"
+	//dbwriter instance which forwarded request to instance which gave out id of the patient,
+	//forwarded request is never forwarded again
+	HeaderForwardedBy = "forwarded-by"
+)
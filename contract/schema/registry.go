@@ -0,0 +1,128 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Registry keeps every version of every subject in <dir>/<subject>.json,
+// directory is shared by all services
+type Registry struct {
+	dir string
+}
+
+func Open(dir string) (*Registry, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open schema registry: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("schema registry %s is not a directory", dir)
+	}
+	return &Registry{dir: dir}, nil
+}
+
+// Register checks schema against every registered version of its subject.
+// Compatible schema which differs from every registered version is registered as the next version,
+// so old and new services restarted in turn don't add versions. Version of the schema in registry is returned.
+// Registry is locked meanwhile, so services starting together don't overwrite versions of each other
+func (r *Registry) Register(s Schema) (int, error) {
+	unlock, err := r.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	versions, err := r.Versions(s.Subject)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, old := range versions {
+		if err := Compatible(old, s); err != nil {
+			return 0, fmt.Errorf("schema is incompatible with registry: %w", err)
+		}
+	}
+
+	for _, old := range versions {
+		if equal(old, s) {
+			return old.Version, nil
+		}
+	}
+
+	s.Version = len(versions) + 1
+	if err := r.write(s.Subject, append(versions, s)); err != nil {
+		return 0, err
+	}
+	return s.Version, nil
+}
+
+// lock takes exclusive lock of registry directory, it is held until unlock is called
+func (r *Registry) lock() (unlock func(), err error) {
+	dir, err := os.Open(r.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open schema registry: %w", err)
+	}
+
+	if err := syscall.Flock(int(dir.Fd()), syscall.LOCK_EX); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("failed to lock schema registry: %w", err)
+	}
+
+	return func() {
+		syscall.Flock(int(dir.Fd()), syscall.LOCK_UN)
+		dir.Close()
+	}, nil
+}
+
+// Versions returns registered versions of subject starting from the first one
+func (r *Registry) Versions(subject string) ([]Schema, error) {
+	data, err := os.ReadFile(r.path(subject))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema %s: %w", subject, err)
+	}
+
+	var versions []Schema
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("failed to decode schema %s: %w", subject, err)
+	}
+	return versions, nil
+}
+
+// write replaces file of subject at once, so other service never reads half written file
+func (r *Registry) write(subject string, versions []Schema) error {
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode schema %s: %w", subject, err)
+	}
+
+	tmp, err := os.CreateTemp(r.dir, subject+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to register schema %s: %w", subject, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to register schema %s: %w", subject, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to register schema %s: %w", subject, err)
+	}
+
+	if err := os.Rename(tmp.Name(), r.path(subject)); err != nil {
+		return fmt.Errorf("failed to register schema %s: %w", subject, err)
+	}
+	return nil
+}
+
+func (r *Registry) path(subject string) string {
+	return filepath.Join(r.dir, subject+".json")
+}
@@ -0,0 +1,162 @@
+package schema
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var patientV1 = Schema{Subject: "Patient", Fields: []Field{
+	{Number: 1, Name: "id", Type: "uint64"},
+	{Number: 2, Name: "name", Type: "string"},
+}}
+
+var patientV2 = Schema{Subject: "Patient", Fields: []Field{
+	{Number: 1, Name: "id", Type: "uint64"},
+	{Number: 2, Name: "name", Type: "string"},
+	{Number: 3, Name: "last_name", Type: "string"},
+}}
+
+func TestCompatible(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []Field
+		ok     bool
+	}{
+		{"same fields", patientV1.Fields, true},
+		{"added field", patientV2.Fields, true},
+		{"removed field", []Field{{Number: 1, Name: "id", Type: "uint64"}}, true},
+		{"changed type", []Field{{Number: 1, Name: "id", Type: "string"}}, false},
+		{"renamed field", []Field{{Number: 2, Name: "first_name", Type: "string"}}, false},
+		{"became repeated", []Field{{Number: 2, Name: "name", Type: "string", Repeated: true}}, false},
+		{"moved name", []Field{{Number: 1, Name: "id", Type: "uint64"}, {Number: 4, Name: "name", Type: "string"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Compatible(patientV1, Schema{Subject: "Patient", Fields: tt.fields})
+			if tt.ok && err != nil {
+				t.Fatalf("expected compatible schema, got %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected incompatible schema")
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//old and new services restarted in turn
+	want := []int{1, 2, 1, 2, 1}
+	for i, s := range []Schema{patientV1, patientV2, patientV1, patientV2, patientV1} {
+		version, err := r.Register(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != want[i] {
+			t.Fatalf("registration %d: got version %d, want %d", i, version, want[i])
+		}
+	}
+
+	versions, err := r.Versions("Patient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("got %d registered versions, want 2", len(versions))
+	}
+}
+
+func TestRegisterIncompatible(t *testing.T) {
+	r, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Register(patientV2); err != nil {
+		t.Fatal(err)
+	}
+
+	//last_name was added in version 1, so it can't change its type even after it is removed
+	incompatible := Schema{Subject: "Patient", Fields: []Field{{Number: 3, Name: "last_name", Type: "bytes"}}}
+	if _, err := r.Register(incompatible); err == nil {
+		t.Fatal("expected incompatible schema to be refused")
+	}
+
+	versions, err := r.Versions("Patient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("got %d registered versions, want 1", len(versions))
+	}
+}
+
+func TestOpenNotDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path); err == nil {
+		t.Fatal("expected error for file instead of directory")
+	}
+}
+
+// services of different builds starting together register their versions without losing each other's
+func TestRegisterConcurrently(t *testing.T) {
+	dir := t.TempDir()
+
+	schemas := make([]Schema, 20)
+	for i := range schemas {
+		schemas[i] = Schema{Subject: "Patient", Fields: []Field{
+			{Number: 1, Name: "id", Type: "uint64"},
+			{Number: 10 + i, Name: fmt.Sprintf("field_%d", i), Type: "string"},
+		}}
+	}
+
+	var wg sync.WaitGroup
+	registered := make([]int, len(schemas))
+	errs := make([]error, len(schemas))
+	for i, s := range schemas {
+		wg.Add(1)
+		go func(i int, s Schema) {
+			defer wg.Done()
+
+			//every service opens registry itself
+			r, err := Open(dir)
+			if err == nil {
+				registered[i], err = r.Register(s)
+			}
+			errs[i] = err
+		}(i, s)
+	}
+	wg.Wait()
+
+	r, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := r.Versions("Patient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != len(schemas) {
+		t.Fatalf("got %d registered versions, want %d", len(versions), len(schemas))
+	}
+
+	for i, s := range schemas {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if !equal(versions[registered[i]-1], s) {
+			t.Fatalf("version %d returned for schema %d belongs to another schema", registered[i], i)
+		}
+	}
+}
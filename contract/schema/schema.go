@@ -0,0 +1,62 @@
+// Package schema describes protobuf payloads and keeps their versions in file-based registry,
+// service refuses to start if its schema is incompatible with registered one
+package schema
+
+import "fmt"
+
+// Field is protobuf field, Type is scalar type or subject of nested message
+type Field struct {
+	Number   int    `json:"number"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Repeated bool   `json:"repeated,omitempty"`
+}
+
+// Schema is version of message fields, fields can be added and removed, but never changed
+type Schema struct {
+	Subject string  `json:"subject"`
+	Version int     `json:"version"`
+	Fields  []Field `json:"fields"`
+}
+
+// Compatible returns error if peer with schema s can't read messages written with old schema or vice versa:
+// field number has to keep its name, type and cardinality, and field name can't move to another number.
+// Unknown fields are skipped by readers, so fields may be added and removed
+func Compatible(old Schema, s Schema) error {
+	byNumber := make(map[int]Field, len(old.Fields))
+	byName := make(map[string]Field, len(old.Fields))
+	for _, f := range old.Fields {
+		byNumber[f.Number] = f
+		byName[f.Name] = f
+	}
+
+	for _, f := range s.Fields {
+		if was, ok := byNumber[f.Number]; ok && was != f {
+			return fmt.Errorf("field %d of %s is %s, it was %s in version %d", f.Number, s.Subject, f, was, old.Version)
+		}
+		if was, ok := byName[f.Name]; ok && was.Number != f.Number {
+			return fmt.Errorf("field %s of %s has number %d, it was %d in version %d", f.Name, s.Subject, f.Number, was.Number, old.Version)
+		}
+	}
+	return nil
+}
+
+// equal tells if schemas have the same fields in the same order
+func equal(a Schema, b Schema) bool {
+	if len(a.Fields) != len(b.Fields) {
+		return false
+	}
+	for i := range a.Fields {
+		if a.Fields[i] != b.Fields[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Field) String() string {
+	if f.Repeated {
+		return fmt.Sprintf("repeated %s %s", f.Type, f.Name)
+	}
+	return fmt.Sprintf("%s %s", f.Type, f.Name)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"contract/messages"
 	"dbWriter/internal/config"
 	csvwriter "dbWriter/internal/csvWriter"
 	"dbWriter/internal/database"
+	"dbWriter/internal/idalloc"
 	"dbWriter/internal/kafka"
 	"dbWriter/pkg/sl"
 	"log/slog"
@@ -12,10 +14,9 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
-var PatientId = 0
-
 func main() {
 	configPath := os.Getenv("CONFIG_PATH")
 
@@ -36,6 +37,36 @@ func main() {
 		os.Exit(1)
 	}
 
+	csvCfg, err := config.ReadCsvConfig(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	idCfg, err := config.ReadIdConfig(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	reqCfg, err := config.ReadRequestConfig(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	schemaCfg, err := config.ReadSchemaConfig(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	//dbwriter refuses to start if its protobuf schemas are incompatible with ones registered by other services
+	if err := messages.RegisterSchemas(schemaCfg.Registry); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
 	//created db instanse
 	db, err := database.Connect(dbCfg)
 	if err != nil {
@@ -47,6 +78,12 @@ func main() {
 
 	slog.Info("succesfully connect to database")
 
+	if err := db.InitIdSequence(idCfg.BlockSize); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	ids := idalloc.New(db, idCfg.InstanceId)
+
 	//created temp csv file
 	csvDirPath, err := filepath.Abs("./temp/")
 	if err != nil {
@@ -54,13 +91,58 @@ func main() {
 		os.Exit(1)
 	}
 
-	cw := csvwriter.New(csvDirPath)
+	cw := csvwriter.New(csvDirPath, csvwriter.FlushPolicy{
+		MaxRows:  csvCfg.MaxRows,
+		MaxBytes: csvCfg.MaxBytes,
+		MaxAge:   csvCfg.MaxAge,
+	})
 	cw.CreateNewFile()
 	defer cw.Close()
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
 	defer stop()
 
-	k, err := kafka.New([]string{kCfg.Host})
-	k.Start(ctx, kCfg.Topic, cw, db)
+	go deleteExpired(ctx, db, reqCfg)
+
+	k, err := kafka.New([]string{kCfg.Host}, kCfg.Group, idCfg.InstanceId, kCfg.RebalanceStrategy, kCfg.InitialOffset, kCfg.Encoding)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	k.Start(ctx, kCfg.Topic, cw, db, ids, kafka.RetryPolicy{
+		Attempts: csvCfg.RetryAttempts,
+		Backoff:  csvCfg.RetryBackoff,
+	})
+
+	//ids left in the block are never used again
+	slog.Info("released id block", slog.Any("block", ids.Block()))
+}
+
+// deleteExpired deletes expired statuses of asynchronous requests and idempotency keys every hour
+func deleteExpired(ctx context.Context, db *database.Repository, reqCfg *config.RequestConfig) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := db.DeleteRequestStatuses(reqCfg.StatusTtl)
+		if err != nil {
+			slog.Error(err.Error())
+		} else if deleted > 0 {
+			slog.Info("deleted old request statuses", slog.Int64("count", deleted))
+		}
+
+		deleted, err = db.DeleteIdempotencyKeys(reqCfg.IdempotencyTtl)
+		if err != nil {
+			slog.Error(err.Error())
+		} else if deleted > 0 {
+			slog.Info("deleted old idempotency keys", slog.Int64("count", deleted))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -1,9 +1,92 @@
 package commonerr
 
-type Error struct {
-	Err string `json:"err"`
+import (
+	"contract/entities"
+	"contract/messages"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strings"
+)
+
+// codedError is error which knows its code from messages catalogue
+type codedError struct {
+	code string
+	msg  string
+}
+
+func (e codedError) Error() string {
+	return e.msg
+}
+
+func NotFound(msg string) error {
+	return codedError{code: messages.CodeNotFound, msg: msg}
+}
+
+func Invalid(msg string) error {
+	return codedError{code: messages.CodeValidation, msg: msg}
+}
+
+func Conflict(msg string) error {
+	return codedError{code: messages.CodeConflict, msg: msg}
+}
+
+func Timeout(msg string) error {
+	return codedError{code: messages.CodeTimeout, msg: msg}
+}
+
+func Unavailable(msg string) error {
+	return codedError{code: messages.CodeUnavailable, msg: msg}
+}
+
+// FromError makes error response with code of the error,
+// invalid fields of the patient are sent one by one
+func FromError(err error) messages.Error {
+	var validationErr entities.ValidationError
+	if errors.As(err, &validationErr) {
+		return messages.Error{Code: messages.CodeValidation, Err: messages.ErrInvalidPatient, Fields: validationErr}
+	}
+	return messages.NewError(Code(err), err.Error())
+}
+
+// Code returns code of the error, errors of unreachable database are UNAVAILABLE
+// and errors without code are INTERNAL
+func Code(err error) string {
+	var coded codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return messages.CodeUnavailable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return messages.CodeUnavailable
+	}
+
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return sqlStateCode(pgErr.SQLState())
+	}
+
+	return messages.CodeInternal
 }
 
-func New(msg string) Error {
-	return Error{msg}
+// sqlStateCode chooses code by class of postgreSQL error
+func sqlStateCode(state string) string {
+	switch {
+	//data exception
+	case strings.HasPrefix(state, "22"):
+		return messages.CodeValidation
+	//integrity constraint violation
+	case strings.HasPrefix(state, "23"):
+		return messages.CodeConflict
+	//connection exception, insufficient resources, operator intervention
+	case strings.HasPrefix(state, "08"), strings.HasPrefix(state, "53"), strings.HasPrefix(state, "57"):
+		return messages.CodeUnavailable
+	default:
+		return messages.CodeInternal
+	}
 }
@@ -1,8 +1,10 @@
 package config
 
 import (
+	"contract/messages"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -19,11 +21,60 @@ type DatabaseConfig struct {
 type KafkaConfig struct {
 	Host  string
 	Topic string `mapstructure:"topic"`
+	//all dbwriter instances with the same group split partitions between each other
+	Group             string `mapstructure:"group"`
+	RebalanceStrategy string `mapstructure:"rebalance_strategy"`
+	//committed, oldest or newest
+	InitialOffset string `mapstructure:"initial_offset"`
+	//json or protobuf, replies without protobuf schema are always json
+	Encoding string `mapstructure:"encoding"`
+}
+
+type SchemaConfig struct {
+	//directory of schema registry shared with server
+	Registry string `mapstructure:"registry"`
+}
+
+type CsvConfig struct {
+	//file is imported when any of limits is reached, zero rows or bytes means no limit
+	MaxRows  int           `mapstructure:"max_rows"`
+	MaxBytes int64         `mapstructure:"max_bytes"`
+	MaxAge   time.Duration `mapstructure:"max_age"`
+	//failed import is repeated with doubling backoff
+	RetryAttempts int           `mapstructure:"retry_attempts"`
+	RetryBackoff  time.Duration `mapstructure:"retry_backoff"`
+}
+
+type RequestConfig struct {
+	//statuses of asynchronous requests are deleted after this time
+	StatusTtl time.Duration `mapstructure:"status_ttl"`
+	//request repeated with the same idempotency key later than this creates new patient
+	IdempotencyTtl time.Duration `mapstructure:"idempotency_ttl"`
+}
+
+type IdConfig struct {
+	//amount of ids reserved by instance at once
+	BlockSize  int `mapstructure:"block_size"`
+	InstanceId string
 }
 
 func Init(path string) (*viper.Viper, error) {
 	v := viper.New()
 	v.SetConfigFile(path)
+	v.SetDefault("kafka.topic", messages.TopicCreatePatient)
+	v.SetDefault("kafka.group", "dbwriter")
+	v.SetDefault("kafka.rebalance_strategy", "sticky")
+	v.SetDefault("kafka.initial_offset", "committed")
+	v.SetDefault("kafka.encoding", messages.EncodingJson)
+	v.SetDefault("schemas.registry", "../schemas")
+	v.SetDefault("ids.block_size", 1000)
+	v.SetDefault("csv.max_rows", 0)
+	v.SetDefault("csv.max_bytes", 0)
+	v.SetDefault("csv.max_age", time.Minute)
+	v.SetDefault("csv.retry_attempts", 5)
+	v.SetDefault("csv.retry_backoff", time.Second)
+	v.SetDefault("requests.status_ttl", 7*24*time.Hour)
+	v.SetDefault("requests.idempotency_ttl", 24*time.Hour)
 
 	if err := v.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("failed to read config, err: %s", err.Error())
@@ -51,6 +102,10 @@ func ReadKafkaConfig(v *viper.Viper) (*KafkaConfig, error) {
 		return nil, fmt.Errorf("failed to read database config")
 	}
 
+	if err := messages.CheckEncoding(kCfg.Encoding); err != nil {
+		return nil, err
+	}
+
 	kafkaHost := os.Getenv("KAFKA_HOST")
 	if kafkaHost == "" {
 		return nil, fmt.Errorf("failed to read POSTGRES_PASSWORD env variable")
@@ -59,3 +114,68 @@ func ReadKafkaConfig(v *viper.Viper) (*KafkaConfig, error) {
 	kCfg.Host = kafkaHost
 	return &kCfg, nil
 }
+
+func ReadIdConfig(v *viper.Viper) (*IdConfig, error) {
+	var idCfg IdConfig
+	if err := v.UnmarshalKey("ids", &idCfg); err != nil {
+		return nil, fmt.Errorf("failed to read ids config")
+	}
+
+	if idCfg.BlockSize <= 0 {
+		return nil, fmt.Errorf("ids block_size must be positive")
+	}
+
+	idCfg.InstanceId = os.Getenv("INSTANCE_ID")
+	if idCfg.InstanceId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read INSTANCE_ID env variable and hostname")
+		}
+		idCfg.InstanceId = hostname
+	}
+
+	return &idCfg, nil
+}
+
+func ReadCsvConfig(v *viper.Viper) (*CsvConfig, error) {
+	var csvCfg CsvConfig
+	if err := v.UnmarshalKey("csv", &csvCfg); err != nil {
+		return nil, fmt.Errorf("failed to read csv config")
+	}
+
+	if csvCfg.MaxRows < 0 || csvCfg.MaxBytes < 0 || csvCfg.MaxAge <= 0 {
+		return nil, fmt.Errorf("csv limits must not be negative and max_age must be positive")
+	}
+
+	if csvCfg.RetryAttempts <= 0 || csvCfg.RetryBackoff < 0 {
+		return nil, fmt.Errorf("csv retry_attempts must be positive and retry_backoff must not be negative")
+	}
+
+	return &csvCfg, nil
+}
+
+func ReadRequestConfig(v *viper.Viper) (*RequestConfig, error) {
+	var reqCfg RequestConfig
+	if err := v.UnmarshalKey("requests", &reqCfg); err != nil {
+		return nil, fmt.Errorf("failed to read requests config")
+	}
+
+	if reqCfg.StatusTtl <= 0 || reqCfg.IdempotencyTtl <= 0 {
+		return nil, fmt.Errorf("requests status_ttl and idempotency_ttl must be positive")
+	}
+
+	return &reqCfg, nil
+}
+
+func ReadSchemaConfig(v *viper.Viper) (*SchemaConfig, error) {
+	var schemaCfg SchemaConfig
+	if err := v.UnmarshalKey("schemas", &schemaCfg); err != nil {
+		return nil, fmt.Errorf("failed to read schemas config")
+	}
+
+	if schemaCfg.Registry == "" {
+		return nil, fmt.Errorf("schemas registry must be set")
+	}
+
+	return &schemaCfg, nil
+}
@@ -1,57 +1,348 @@
 package csvwriter
 
 import (
-	entities "dbWriter/internal/entities"
+	"bytes"
+	entities "contract/entities"
 	"dbWriter/pkg/sl"
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"golang.org/x/exp/slog"
 )
 
-type CsvWriter struct {
+// request_id is not imported into patients, status of the request is saved by it
+var header = []string{"id", "name", "last_name", "date_of_birth", "blood_type", "rh_factor", "request_id"}
+
+// FlushPolicy tells when file has to be imported, whichever limit is reached first,
+// zero MaxRows or MaxBytes means no limit
+type FlushPolicy struct {
+	MaxRows  int
+	MaxBytes int64
+	MaxAge   time.Duration
+}
+
+// Batch is sealed csv file which is waiting for import,
+// file stays locked until it is removed
+type Batch struct {
+	Path string
+	Rows int
 	file *os.File
-	Dir  string
+
+	//patients of the batch are readable from writer until batch is removed
+	ids []int
+	cw  *CsvWriter
+}
+
+// Remove deletes batch file after it was imported
+func (b Batch) Remove() {
+	if err := os.Remove(b.Path); err != nil {
+		slog.Error("failed to remove csv file", slog.String("file", b.Path), sl.Error(err))
+	}
+	b.file.Close()
+
+	if b.cw != nil {
+		b.cw.forget(b.ids)
+	}
+}
+
+// CsvWriter writes patients into current file, Rotate seals it and switches writing to a new one,
+// so writes don't wait for import of previous file
+type CsvWriter struct {
+	//protects everything below
+	mu sync.Mutex
+
+	file   *os.File
+	writer *csv.Writer
+	Dir    string
+
+	policy    FlushPolicy
+	rows      int
+	bytes     *countingWriter
+	createdAt time.Time
+	//signals that rows or bytes limit is reached
+	flush chan struct{}
+
+	//paths to files left by crashed dbwriter which are already found
+	orphans map[string]bool
+
+	//patients which are written but not imported yet, by id
+	pending map[int]entities.Patient
+	//ids of pending patients by requests which created them and back
+	requests   map[string]int
+	requestIds map[int]string
+	//ids of patients in current file
+	ids []int
+	//channels closed when patient leaves memory after import
+	waiters map[int][]chan struct{}
 }
 
 //TODO: implement create start file there
 
-func New(dirPath string) *CsvWriter {
-	return &CsvWriter{Dir: dirPath}
+func New(dirPath string, policy FlushPolicy) *CsvWriter {
+	return &CsvWriter{
+		Dir:     dirPath,
+		policy:  policy,
+		flush:   make(chan struct{}, 1),
+		orphans: make(map[string]bool),
+		pending: make(map[int]entities.Patient),
+		waiters: make(map[int][]chan struct{}),
+
+		requests:   make(map[string]int),
+		requestIds: make(map[int]string),
+	}
+}
+
+// countingWriter counts bytes written to the file
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
 func (cw *CsvWriter) CreateNewFile() {
-	tempFile, err := os.CreateTemp(cw.Dir, "patients-*.csv")
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if err := cw.createFile(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// createFile starts writing to a new file, previous file is left as it is
+func (cw *CsvWriter) createFile() error {
+	//timestamp in name keeps file names unique, they are remembered in database after import
+	tempFile, err := os.CreateTemp(cw.Dir, fmt.Sprintf("patients-%d-*.csv", time.Now().UnixNano()))
 	if err != nil {
-		log.Fatal("failed to create temp file: %w", err)
+		return fmt.Errorf("failed to create temp file: %w", err)
 	}
 
 	err = os.Chmod(tempFile.Name(), 0644)
 	if err != nil {
-		log.Fatal("failed to change chmod")
+		tempFile.Close()
+		return fmt.Errorf("failed to change chmod: %w", err)
 	}
 
-	if cw.file != nil {
-		cw.file.Close()
-		os.Remove(cw.GetPathToFile())
+	//lock tells other dbwriter instances sharing the dir that file is in use
+	if err := syscall.Flock(int(tempFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to lock temp file: %w", err)
 	}
 
-	fmt.Fprintln(tempFile, "id,name,last_name,date_of_birth,blood_type,rh_factor")
 	cw.file = tempFile
+	cw.bytes = &countingWriter{w: tempFile}
+	cw.writer = csv.NewWriter(cw.bytes)
+	cw.writer.Write(header)
+	cw.writer.Flush()
+	cw.rows = 0
+	cw.ids = nil
+	cw.createdAt = time.Now()
+	return nil
 }
 
-func (cw *CsvWriter) Write(patient entities.Patient, id int) error {
-	_, err := fmt.Fprintf(cw.file, "%d,%s,%s,%s,%d,%s\n", id, patient.Name, patient.LastName,
-		patient.DateOfBirth, patient.BloodType, patient.RhFactor)
-	if err != nil {
+// Rotate seals current file and starts a new one, sealed file is returned for import
+func (cw *CsvWriter) Rotate() (Batch, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	sealed := Batch{Path: cw.file.Name(), Rows: cw.rows, file: cw.file, ids: cw.ids, cw: cw}
+	if err := cw.createFile(); err != nil {
+		return Batch{}, err
+	}
+
+	//limit signal belongs to sealed file
+	select {
+	case <-cw.flush:
+	default:
+	}
+
+	return sealed, nil
+}
+
+func (cw *CsvWriter) Write(patient entities.Patient, id int, requestId string) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	//csv writer quotes values, so commas in names don't break the file
+	cw.writer.Write([]string{strconv.Itoa(id), patient.Name, patient.LastName,
+		patient.DateOfBirth.String(), strconv.Itoa(int(patient.BloodType)), patient.RhFactor, requestId})
+	cw.writer.Flush()
+	if err := cw.writer.Error(); err != nil {
 		return fmt.Errorf("failed to write to csv file: %w", err)
 	}
 
+	//patient must be on disk before kafka offset is committed
+	if err := cw.file.Sync(); err != nil {
+		return fmt.Errorf("failed to flush csv file: %w", err)
+	}
+
+	cw.rows++
+	patient.Id = uint(id)
+	cw.pending[id] = patient
+	cw.ids = append(cw.ids, id)
+	if requestId != "" {
+		cw.requests[requestId] = id
+		cw.requestIds[id] = requestId
+	}
+
+	if (cw.policy.MaxRows > 0 && cw.rows >= cw.policy.MaxRows) ||
+		(cw.policy.MaxBytes > 0 && cw.bytes.n >= cw.policy.MaxBytes) {
+		select {
+		case cw.flush <- struct{}{}:
+		default:
+		}
+	}
+
 	return nil
 }
 
-func (cw CsvWriter) GetFileName() (string, error) {
+// Find returns patient which is written but not imported into database yet
+func (cw *CsvWriter) Find(id int) (entities.Patient, bool) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	patient, ok := cw.pending[id]
+	return patient, ok
+}
+
+// FindRequest returns id of patient created by the request if the patient is not imported into database yet
+func (cw *CsvWriter) FindRequest(requestId string) (int, bool) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	id, ok := cw.requests[requestId]
+	return id, ok
+}
+
+// WaitImported returns channel which is closed when patient is imported or rejected by database,
+// nil is returned if patient is not waiting for import. inCurrent tells that patient is in current file
+// and it won't be imported until file is rotated
+func (cw *CsvWriter) WaitImported(id int) (done <-chan struct{}, inCurrent bool) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if _, ok := cw.pending[id]; !ok {
+		return nil, false
+	}
+
+	ch := make(chan struct{})
+	cw.waiters[id] = append(cw.waiters[id], ch)
+
+	for _, currentId := range cw.ids {
+		if currentId == id {
+			return ch, true
+		}
+	}
+	return ch, false
+}
+
+func (cw *CsvWriter) forget(ids []int) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	for _, id := range ids {
+		delete(cw.pending, id)
+		delete(cw.requests, cw.requestIds[id])
+		delete(cw.requestIds, id)
+		for _, ch := range cw.waiters[id] {
+			close(ch)
+		}
+		delete(cw.waiters, id)
+	}
+}
+
+// FlushSignal returns channel which gets value when file reached rows or bytes limit
+func (cw *CsvWriter) FlushSignal() <-chan struct{} {
+	return cw.flush
+}
+
+// FlushAfter returns time left until current file reaches max age
+func (cw *CsvWriter) FlushAfter() time.Duration {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return time.Until(cw.createdAt.Add(cw.policy.MaxAge))
+}
+
+// Orphans returns csv files left in the dir by crashed dbwriter,
+// files which are used by running instances are skipped
+func (cw *CsvWriter) Orphans() ([]Batch, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(cw.Dir, "patients-*.csv"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find orphaned csv files, err: %s", err.Error())
+	}
+
+	var orphans []Batch
+	for _, path := range paths {
+		if cw.orphans[path] || (cw.file != nil && path == cw.file.Name()) {
+			continue
+		}
+
+		file, err := os.OpenFile(path, os.O_RDWR, 0644)
+		if err != nil {
+			slog.Error("failed to open orphaned csv file", slog.String("file", path), sl.Error(err))
+			continue
+		}
+
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close()
+			continue
+		}
+
+		rows, err := cutPartialLine(file)
+		if err != nil {
+			slog.Error("failed to repair orphaned csv file", slog.String("file", path), sl.Error(err))
+			file.Close()
+			continue
+		}
+
+		cw.orphans[path] = true
+		orphans = append(orphans, Batch{Path: path, Rows: rows, file: file})
+	}
+
+	return orphans, nil
+}
+
+// cutPartialLine removes last line if crash happened in the middle of writing it,
+// such patient was never acknowledged. Returns amount of patients left in file
+func cutPartialLine(file *os.File) (int, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+
+	end := bytes.LastIndexByte(data, '\n') + 1
+	if end == 0 {
+		return 0, errors.New("csv file has no header")
+	}
+
+	if end < len(data) {
+		if err := file.Truncate(int64(end)); err != nil {
+			return 0, err
+		}
+	}
+	return bytes.Count(data[:end], []byte{'\n'}) - 1, nil
+}
+
+func (cw *CsvWriter) GetFileName() (string, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
 	fileInfo, err := cw.file.Stat()
 	if err != nil {
 		return "", fmt.Errorf("failed to get fileName, err: %s", err.Error())
@@ -59,11 +350,21 @@ func (cw CsvWriter) GetFileName() (string, error) {
 	return fileInfo.Name(), nil
 }
 
-func (cw CsvWriter) GetPathToFile() string {
+func (cw *CsvWriter) GetPathToFile() string {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
 	return cw.file.Name()
 }
 
-func (cw CsvWriter) Close() {
+// Close closes current file, empty file is removed
+func (cw *CsvWriter) Close() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if cw.rows == 0 {
+		os.Remove(cw.file.Name())
+	}
+
 	if err := cw.file.Close(); err != nil {
 		slog.Error("failed to close csv writer", sl.Error(err))
 	}
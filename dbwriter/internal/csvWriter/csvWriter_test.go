@@ -0,0 +1,72 @@
+package csvwriter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testHeader = "id,name,last_name,date_of_birth,blood_type,rh_factor,request_id\n"
+
+func testFile(t *testing.T, data string) *os.File {
+	path := filepath.Join(t.TempDir(), "patients-1.csv")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestCutPartialLine(t *testing.T) {
+	complete := testHeader +
+		"1,John,Doe,2000-01-01,1,positive,request-1\n" +
+		"2,Jane,Doe,2001-02-03,2,negative,request-2\n"
+
+	tests := []struct {
+		name string
+		data string
+		want string
+		rows int
+	}{
+		{"complete file", complete, complete, 2},
+		{"truncated last line", complete + "3,Jim,Do", complete, 2},
+		{"header only", testHeader, testHeader, 0},
+		{"truncated first row", testHeader + "1,Jo", testHeader, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := testFile(t, tt.data)
+
+			rows, err := cutPartialLine(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rows != tt.rows {
+				t.Fatalf("got %d rows, want %d", rows, tt.rows)
+			}
+
+			data, err := os.ReadFile(file.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("got file %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+// file cut in the middle of header has no patients which were acknowledged
+func TestCutPartialLineWithoutHeader(t *testing.T) {
+	for _, data := range []string{"", "id,name,last"} {
+		if _, err := cutPartialLine(testFile(t, data)); err == nil {
+			t.Fatalf("expected error for file %q", data)
+		}
+	}
+}
@@ -1,20 +1,24 @@
 package database
 
 import (
+	"contract/entities"
+	"contract/messages"
 	"database/sql"
+	"dbWriter/internal/common/commonerr"
 	"dbWriter/internal/config"
-	"dbWriter/internal/entities"
 	"dbWriter/pkg/sl"
 	"errors"
 	"fmt"
-	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"golang.org/x/exp/slog"
 )
 
 type Repository struct {
 	db *sql.DB
+
+	//increment of patients_id_seq, every nextval reserves block of this size
+	idBlockSize int
 }
 
 func Connect(cfg *config.DatabaseConfig) (*Repository, error) {
@@ -30,7 +34,7 @@ func Connect(cfg *config.DatabaseConfig) (*Repository, error) {
 		id INTEGER PRIMARY KEY,
 		name TEXT NOT NULL,
 		last_name TEXT NOT NULL,
-		date_of_birth TIMESTAMP NOT NULL,
+		date_of_birth DATE NOT NULL,
 		blood_type INTEGER NOT NULL,
 		rh_factor TEXT NOT NULL);
 		`)
@@ -39,23 +43,190 @@ func Connect(cfg *config.DatabaseConfig) (*Repository, error) {
 		return nil, fmt.Errorf("failed to create patinet's table: %w", err)
 	}
 
+	//date of birth was stored as timestamp before, the date is the same in any time zone only without time
+	_, err = db.Exec(`
+	DO $$
+	BEGIN
+		IF (SELECT data_type FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'patients' AND column_name = 'date_of_birth') <> 'date' THEN
+			ALTER TABLE patients ALTER COLUMN date_of_birth TYPE DATE USING date_of_birth::date;
+		END IF;
+	END $$;
+		`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to change type of date of birth: %w", err)
+	}
+
+	//deleted patients are kept in the table and can be restored
+	_, err = db.Exec(`
+	ALTER TABLE patients
+		ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP,
+		ADD COLUMN IF NOT EXISTS delete_reason TEXT;
+		`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to add soft delete columns: %w", err)
+	}
+
+	//indexes for pages of patients sorted by last name or date of birth
+	_, err = db.Exec(`
+	CREATE INDEX IF NOT EXISTS patients_last_name_idx ON patients(last_name, id);
+	CREATE INDEX IF NOT EXISTS patients_date_of_birth_idx ON patients(date_of_birth, id);
+		`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create patients indexes: %w", err)
+	}
+
+	if err := initSearch(db); err != nil {
+		return nil, err
+	}
+
+	//names of imported csv files, so the same file is never imported twice
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS imported_files(
+		file_name TEXT PRIMARY KEY,
+		imported_at TIMESTAMP NOT NULL DEFAULT now());
+		`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create imported files table: %w", err)
+	}
+
+	//rows rejected by database during import, they are kept as text with the reason
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS patients_quarantine(
+		id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		last_name TEXT NOT NULL,
+		date_of_birth TEXT NOT NULL,
+		blood_type TEXT NOT NULL,
+		rh_factor TEXT NOT NULL,
+		request_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		error TEXT NOT NULL,
+		quarantined_at TIMESTAMP NOT NULL DEFAULT now());
+		`)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create quarantine table: %w", err)
+	}
+
+	if err := initRequestStatuses(db); err != nil {
+		return nil, err
+	}
+
+	if err := initIdempotencyKeys(db); err != nil {
+		return nil, err
+	}
+
 	return &Repository{db: db}, nil
 }
 
-func (r *Repository) ImportFromCsv(fileName string) error {
-	filePath := fmt.Sprintf("/csv/%s", fileName)
+// InitIdSequence creates sequence which patient's ids are reserved from by blocks,
+// blockSize is used only when sequence is created, running instances share increment of existing sequence
+func (r *Repository) InitIdSequence(blockSize int) error {
+	nextId, err := r.FindBiggestId()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(fmt.Sprintf("CREATE SEQUENCE IF NOT EXISTS patients_id_seq INCREMENT BY %d START WITH %d", blockSize, nextId))
+	if err != nil {
+		return fmt.Errorf("failed to create patients id sequence: %w", err)
+	}
+
+	//rows inserted by hand without id take whole block, so they never collide with dbwriter
+	_, err = r.db.Exec("ALTER TABLE patients ALTER COLUMN id SET DEFAULT nextval('patients_id_seq')")
+	if err != nil {
+		return fmt.Errorf("failed to set default id of patients: %w", err)
+	}
 
-	query := fmt.Sprintf("COPY patients FROM '%s' DELIMITER ',' CSV HEADER;", filePath)
+	//move sequence forward if ids were inserted by hand or by old dbwriter
+	_, err = r.db.Exec(`
+	SELECT setval('patients_id_seq', t.max_id)
+	FROM (SELECT MAX(id) AS max_id FROM patients) t, patients_id_seq s
+	WHERE t.max_id >= s.last_value`)
+	if err != nil {
+		return fmt.Errorf("failed to sync patients id sequence: %w", err)
+	}
 
-	_, err := r.db.Exec(query)
+	err = r.db.QueryRow("SELECT increment_by FROM pg_sequences WHERE schemaname = current_schema() AND sequencename = 'patients_id_seq'").
+		Scan(&r.idBlockSize)
 	if err != nil {
-		return fmt.Errorf("failed to import data from csv file: %w", err)
+		return fmt.Errorf("failed to read patients id sequence increment: %w", err)
+	}
+
+	if r.idBlockSize != blockSize {
+		slog.Warn("id block size differs from existing sequence, sequence increment is used",
+			slog.Int("config", blockSize), slog.Int("sequence", r.idBlockSize))
+	}
+
+	//blocks reserved by instances, useful to find who created patient
+	_, err = r.db.Exec(`
+	CREATE TABLE IF NOT EXISTS id_blocks(
+		block_start INTEGER PRIMARY KEY,
+		block_end INTEGER NOT NULL,
+		instance_id TEXT NOT NULL,
+		reserved_at TIMESTAMP NOT NULL DEFAULT now());
+		`)
+	if err != nil {
+		return fmt.Errorf("failed to create id blocks table: %w", err)
+	}
+
+	//block is released when its instance stops and all its patients are imported
+	_, err = r.db.Exec("ALTER TABLE id_blocks ADD COLUMN IF NOT EXISTS released_at TIMESTAMP")
+	if err != nil {
+		return fmt.Errorf("failed to add released_at to id blocks table: %w", err)
+	}
+
+	return nil
+}
+
+// ReserveIdBlock reserves range of ids [start, start+size) for instance
+func (r Repository) ReserveIdBlock(instanceId string) (int, int, error) {
+	var start int
+	if err := r.db.QueryRow("SELECT nextval('patients_id_seq')").Scan(&start); err != nil {
+		return 0, 0, fmt.Errorf("failed to get next id block: %w", err)
+	}
+
+	//requests for patients of the block are routed to its owner, so block without owner is never used
+	_, err := r.db.Exec("INSERT INTO id_blocks(block_start, block_end, instance_id) VALUES ($1, $2, $3)",
+		start, start+r.idBlockSize, instanceId)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to save reserved id block: %w", err)
+	}
+
+	return start, r.idBlockSize, nil
+}
+
+// FindIdOwner returns id of running instance which reserved block with the id,
+// empty for id out of every block or of released block
+func (r Repository) FindIdOwner(id int) (string, error) {
+	var instanceId string
+	err := r.db.QueryRow("SELECT instance_id FROM id_blocks WHERE block_start <= $1 AND $1 < block_end AND released_at IS NULL", id).
+		Scan(&instanceId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to find owner of id: %w", err)
+	}
+	return instanceId, nil
+}
+
+// ReleaseIdBlocks marks blocks of stopped instance as released
+func (r Repository) ReleaseIdBlocks(instanceId string) error {
+	_, err := r.db.Exec("UPDATE id_blocks SET released_at = now() WHERE instance_id = $1 AND released_at IS NULL", instanceId)
+	if err != nil {
+		return fmt.Errorf("failed to release id blocks: %w", err)
 	}
 	return nil
 }
 
 func (r Repository) FindBiggestId() (int, error) {
-	stmt, err := r.db.Prepare("SELECT MAX(id) from patients")
+	stmt, err := r.db.Prepare("SELECT COALESCE(MAX(id), 0) from patients")
 	if err != nil {
 		return 1, fmt.Errorf("failed to prepare statement for finding maximum id in patients talbe: %w", err)
 	}
@@ -69,33 +240,108 @@ func (r Repository) FindBiggestId() (int, error) {
 	return id + 1, nil
 }
 
-func (r Repository) FindPatient(id int) (entities.Patient, error) {
-	stmt, err := r.db.Prepare("SELECT name, last_name, date_of_birth, blood_type, rh_factor FROM patients WHERE id = $1")
+// FindPatient finds patient by id, deleted patient is found only with includeDeleted
+func (r Repository) FindPatient(id int, includeDeleted bool) (entities.Patient, error) {
+	row := r.db.QueryRow("SELECT "+returningColumns+" FROM patients WHERE id = $1 AND (deleted_at IS NULL OR $2)",
+		id, includeDeleted)
+
+	return scanPatient(row, "failed to find patient")
+}
+
+// FindPatients finds patients by ids with one query, deleted patients are found only with includeDeleted
+func (r Repository) FindPatients(ids []int, includeDeleted bool) ([]entities.Patient, error) {
+	rows, err := r.db.Query("SELECT "+returningColumns+" FROM patients WHERE id = ANY($1) AND (deleted_at IS NULL OR $2)",
+		pq.Array(ids), includeDeleted)
 	if err != nil {
-		return entities.Patient{}, fmt.Errorf("failed to prepare statement for finding maximum id in patients talbe: %w", err)
+		return nil, fmt.Errorf("failed to find patients: %w", err)
 	}
+	defer rows.Close()
 
-	var patient entities.Patient
+	var patients []entities.Patient
+	for rows.Next() {
+		patient, err := scanPatient(rows, "failed to read patient")
+		if err != nil {
+			return nil, err
+		}
+		patients = append(patients, patient)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find patients: %w", err)
+	}
 
+	return patients, nil
+}
+
+// UpdatePatient changes fields of patient which are not nil and returns updated patient,
+// deleted patient can't be updated
+func (r Repository) UpdatePatient(update entities.PatientUpdate) (entities.Patient, error) {
+	row := r.db.QueryRow(`
+	UPDATE patients SET
+		name = COALESCE($2, name),
+		last_name = COALESCE($3, last_name),
+		date_of_birth = COALESCE($4, date_of_birth),
+		blood_type = COALESCE($5, blood_type),
+		rh_factor = COALESCE($6, rh_factor)
+	WHERE id = $1 AND deleted_at IS NULL
+	RETURNING `+returningColumns,
+		update.Id, update.Name, update.LastName, update.DateOfBirth, update.BloodType, update.RhFactor)
+
+	return scanPatient(row, "failed to update patient")
+}
+
+// DeletePatient marks patient as deleted, deleting of deleted patient keeps the first time and reason
+func (r Repository) DeletePatient(id int, reason string) (entities.Patient, error) {
+	row := r.db.QueryRow(`
+	UPDATE patients SET
+		delete_reason = CASE WHEN deleted_at IS NULL THEN $2 ELSE delete_reason END,
+		deleted_at = COALESCE(deleted_at, now())
+	WHERE id = $1
+	RETURNING `+returningColumns, id, reason)
+
+	return scanPatient(row, "failed to delete patient")
+}
+
+// RestorePatient removes deleted mark from patient
+func (r Repository) RestorePatient(id int) (entities.Patient, error) {
+	row := r.db.QueryRow(`
+	UPDATE patients SET deleted_at = NULL, delete_reason = NULL
+	WHERE id = $1
+	RETURNING `+returningColumns, id)
+
+	return scanPatient(row, "failed to restore patient")
+}
+
+// returningColumns are read by scanPatient
+const returningColumns = "id, name, last_name, date_of_birth, blood_type, rh_factor, deleted_at, delete_reason"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPatient reads patient returned by query, errors except not existing patient are prefixed with op,
+// columns selected after patient's ones are read into extra
+func scanPatient(row scanner, op string, extra ...any) (entities.Patient, error) {
 	var (
-		firstName   string
-		lastName    string
-		dateOfBirth time.Time
-		bloodType   uint
-		rhFactor    string
+		patient   entities.Patient
+		deletedAt sql.NullTime
+		reason    sql.NullString
 	)
 
-	err = stmt.QueryRow(id).Scan(&firstName, &lastName, &dateOfBirth, &bloodType, &rhFactor)
+	dest := []any{&patient.Id, &patient.Name, &patient.LastName, &patient.DateOfBirth, &patient.BloodType, &patient.RhFactor,
+		&deletedAt, &reason}
+
+	err := row.Scan(append(dest, extra...)...)
 	if errors.Is(err, sql.ErrNoRows) {
-		return entities.Patient{}, fmt.Errorf("patient is not exist")
+		return entities.Patient{}, commonerr.NotFound(messages.ErrPatientNotExist)
+	}
+	if err != nil {
+		return entities.Patient{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	patient.Id = uint(id)
-	patient.Name = firstName
-	patient.LastName = lastName
-	patient.BloodType = bloodType
-	patient.RhFactor = rhFactor
-
+	if deletedAt.Valid {
+		patient.DeletedAt = &deletedAt.Time
+		patient.DeleteReason = reason.String
+	}
 	return patient, nil
 }
 
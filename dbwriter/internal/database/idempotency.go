@@ -0,0 +1,117 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// IdempotencyKey is response remembered for client's idempotency key,
+// RequestHash tells if the key is repeated with the same request
+type IdempotencyKey struct {
+	Key         string
+	RequestHash string
+	RequestId   string
+	Response    []byte
+}
+
+// initIdempotencyKeys creates table with responses remembered by idempotency keys
+func initIdempotencyKeys(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS idempotency_keys(
+		key TEXT PRIMARY KEY,
+		request_hash TEXT NOT NULL,
+		request_id TEXT NOT NULL,
+		response BYTEA NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT now());
+		`)
+
+	if err != nil {
+		return fmt.Errorf("failed to create idempotency keys table: %w", err)
+	}
+	return nil
+}
+
+// ClaimIdempotencyKey remembers response for the key if the key is not used yet. Otherwise the key and
+// response of the first request are returned, request handled again after restart gets its own first response too.
+// Requests with the same key wait for each other on primary key, so only one of them claims the key
+func (r *Repository) ClaimIdempotencyKey(key IdempotencyKey) (IdempotencyKey, bool, error) {
+	res, err := r.db.Exec(`
+	INSERT INTO idempotency_keys(key, request_hash, request_id, response) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (key) DO NOTHING`,
+		key.Key, key.RequestHash, key.RequestId, key.Response)
+	if err != nil {
+		return IdempotencyKey{}, false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	if rows, err := res.RowsAffected(); err == nil && rows == 1 {
+		return key, true, nil
+	}
+
+	stored, found, err := r.FindIdempotencyKey(key.Key)
+	if err != nil {
+		return IdempotencyKey{}, false, err
+	}
+	if !found {
+		//key was released by its request right after conflict
+		return IdempotencyKey{}, false, fmt.Errorf("idempotency key %s is released while it is claimed", key.Key)
+	}
+	return stored, false, nil
+}
+
+// FindIdempotencyKey returns the key with response of request which claimed it, found is false for unused key
+func (r *Repository) FindIdempotencyKey(key string) (IdempotencyKey, bool, error) {
+	stored := IdempotencyKey{Key: key}
+	err := r.db.QueryRow("SELECT request_hash, request_id, response FROM idempotency_keys WHERE key = $1", key).
+		Scan(&stored.RequestHash, &stored.RequestId, &stored.Response)
+	if errors.Is(err, sql.ErrNoRows) {
+		return IdempotencyKey{}, false, nil
+	}
+	if err != nil {
+		return IdempotencyKey{}, false, fmt.Errorf("failed to find idempotency key: %w", err)
+	}
+	return stored, true, nil
+}
+
+// ReleaseIdempotencyKey forgets the key claimed by request which failed, so the request can be repeated
+func (r *Repository) ReleaseIdempotencyKey(key string, requestId string) error {
+	_, err := r.db.Exec("DELETE FROM idempotency_keys WHERE key = $1 AND request_id = $2", key, requestId)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+// releaseRejectedKeys forgets keys of requests whose patients were rejected by import,
+// so the requests can be repeated
+func releaseRejectedKeys(tx *sql.Tx, rejected []RejectedRow) error {
+	var requestIds []string
+	for _, row := range rejected {
+		if row.RequestId != "" {
+			requestIds = append(requestIds, row.RequestId)
+		}
+	}
+	if len(requestIds) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM idempotency_keys WHERE request_id = ANY($1)", pq.Array(requestIds))
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency keys of rejected rows: %w", err)
+	}
+	return nil
+}
+
+// DeleteIdempotencyKeys deletes keys older than ttl, request with such key creates patient again
+func (r *Repository) DeleteIdempotencyKeys(ttl time.Duration) (int64, error) {
+	res, err := r.db.Exec("DELETE FROM idempotency_keys WHERE created_at < now() - make_interval(secs => $1)", ttl.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old idempotency keys: %w", err)
+	}
+
+	deleted, _ := res.RowsAffected()
+	return deleted, nil
+}
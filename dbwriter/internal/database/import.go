@@ -0,0 +1,234 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lib/pq"
+	"golang.org/x/exp/slog"
+)
+
+var patientColumns = []string{"id", "name", "last_name", "date_of_birth", "blood_type", "rh_factor"}
+
+// RejectedRow is csv row which database refused to import
+type RejectedRow struct {
+	Values    []string
+	RequestId string
+	Err       string
+}
+
+// csvRow is line of csv file: patient's columns and request which created the patient
+type csvRow struct {
+	values    []string
+	requestId string
+}
+
+// ImportFromCsv streams csv file to postgres by COPY FROM STDIN in one transaction with remembering
+// its name, file which was already imported is skipped.
+// Rows which database rejects are found by bisecting the file, moved to quarantine table and returned,
+// other rows are imported. Requests of the rows get their statuses in the same transaction
+func (r *Repository) ImportFromCsv(filePath string) ([]RejectedRow, error) {
+	fileName := filepath.Base(filePath)
+
+	rows, err := readCsv(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO imported_files(file_name) VALUES ($1) ON CONFLICT DO NOTHING", fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to remember imported file: %w", err)
+	}
+
+	if rows, err := res.RowsAffected(); err == nil && rows == 0 {
+		slog.Info("csv file is already imported", slog.String("file", fileName))
+		return nil, nil
+	}
+
+	rejected, err := copyBisecting(txCopier{tx}, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rejected {
+		_, err := tx.Exec(`INSERT INTO patients_quarantine(id, name, last_name, date_of_birth, blood_type, rh_factor, request_id, file_name, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			row.Values[0], row.Values[1], row.Values[2], row.Values[3], row.Values[4], row.Values[5], row.RequestId, fileName, row.Err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to quarantine row: %w", err)
+		}
+	}
+
+	if err := saveImportStatuses(tx, rows, rejected); err != nil {
+		return nil, err
+	}
+
+	if err := releaseRejectedKeys(tx, rejected); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit import: %w", err)
+	}
+	return rejected, nil
+}
+
+// readCsv reads rows of csv file, columns are found by header
+// so files written before request columns were added are read too
+func readCsv(filePath string) ([]csvRow, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open csv file: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+
+	index := make(map[string]int, len(header))
+	for i, column := range header {
+		index[column] = i
+	}
+	for _, column := range patientColumns {
+		if _, ok := index[column]; !ok {
+			return nil, fmt.Errorf("csv file has no column %s", column)
+		}
+	}
+
+	var rows []csvRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv file: %w", err)
+		}
+
+		row := csvRow{values: make([]string, len(patientColumns))}
+		for i, column := range patientColumns {
+			row.values[i] = record[index[column]]
+		}
+		if i, ok := index["request_id"]; ok {
+			row.requestId = record[i]
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// copier copies rows inside transaction which supports savepoints
+type copier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	copyRows(rows []csvRow) error
+}
+
+// txCopier copies rows by COPY FROM STDIN
+type txCopier struct {
+	*sql.Tx
+}
+
+func (t txCopier) copyRows(rows []csvRow) error {
+	return copyRows(t.Tx, rows)
+}
+
+// copyBisecting copies rows inside savepoint, if database rejects data
+// rows are split in halves until every bad row is found
+func copyBisecting(tx copier, rows []csvRow) ([]RejectedRow, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	if _, err := tx.Exec("SAVEPOINT bisect"); err != nil {
+		return nil, fmt.Errorf("failed to create savepoint: %w", err)
+	}
+
+	err := tx.copyRows(rows)
+	if err == nil {
+		if _, err := tx.Exec("RELEASE SAVEPOINT bisect"); err != nil {
+			return nil, fmt.Errorf("failed to release savepoint: %w", err)
+		}
+		return nil, nil
+	}
+
+	if !isDataError(err) {
+		return nil, fmt.Errorf("failed to import data from csv file: %w", err)
+	}
+
+	if _, err := tx.Exec("ROLLBACK TO SAVEPOINT bisect"); err != nil {
+		return nil, fmt.Errorf("failed to rollback to savepoint: %w", err)
+	}
+	if _, err := tx.Exec("RELEASE SAVEPOINT bisect"); err != nil {
+		return nil, fmt.Errorf("failed to release savepoint: %w", err)
+	}
+
+	if len(rows) == 1 {
+		return []RejectedRow{{
+			Values:    rows[0].values,
+			RequestId: rows[0].requestId,
+			Err:       err.Error(),
+		}}, nil
+	}
+
+	middle := len(rows) / 2
+	left, err := copyBisecting(tx, rows[:middle])
+	if err != nil {
+		return nil, err
+	}
+	right, err := copyBisecting(tx, rows[middle:])
+	if err != nil {
+		return nil, err
+	}
+
+	return append(left, right...), nil
+}
+
+func copyRows(tx *sql.Tx, rows []csvRow) error {
+	stmt, err := tx.Prepare(pq.CopyIn("patients", patientColumns...))
+	if err != nil {
+		return fmt.Errorf("failed to prepare copy statement: %w", err)
+	}
+	defer stmt.Close()
+
+	values := make([]any, len(patientColumns))
+	for _, row := range rows {
+		for i := range row.values {
+			values[i] = row.values[i]
+		}
+
+		if _, err := stmt.Exec(values...); err != nil {
+			return err
+		}
+	}
+
+	//empty Exec sends buffered rows and finishes COPY
+	_, err = stmt.Exec()
+	return err
+}
+
+// isDataError tells if postgres rejected data itself: bad value or broken constraint,
+// such rows fail on every retry
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+
+	class := pqErr.Code.Class()
+	return class == "22" || class == "23"
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// fakeCopier imports rows in memory, COPY of rows with bad id fails like unique violation
+type fakeCopier struct {
+	bad map[string]bool
+	err error
+
+	imported   []string
+	savepoints []int
+}
+
+func (f *fakeCopier) Exec(query string, args ...any) (sql.Result, error) {
+	switch {
+	case strings.HasPrefix(query, "SAVEPOINT"):
+		f.savepoints = append(f.savepoints, len(f.imported))
+	case strings.HasPrefix(query, "ROLLBACK TO SAVEPOINT"):
+		f.imported = f.imported[:f.savepoints[len(f.savepoints)-1]]
+	case strings.HasPrefix(query, "RELEASE SAVEPOINT"):
+		f.savepoints = f.savepoints[:len(f.savepoints)-1]
+	default:
+		return nil, errors.New("unexpected query " + query)
+	}
+	return nil, nil
+}
+
+func (f *fakeCopier) copyRows(rows []csvRow) error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, row := range rows {
+		if f.bad[row.values[0]] {
+			return &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}
+		}
+	}
+	for _, row := range rows {
+		f.imported = append(f.imported, row.values[0])
+	}
+	return nil
+}
+
+func testRows(n int) []csvRow {
+	rows := make([]csvRow, n)
+	for i := range rows {
+		id := strconv.Itoa(i + 1)
+		rows[i] = csvRow{values: []string{id, "John", "Doe", "2000-01-01", "1", "positive"}, requestId: "request-" + id}
+	}
+	return rows
+}
+
+func TestCopyBisecting(t *testing.T) {
+	tests := []struct {
+		name string
+		rows int
+		bad  []string
+	}{
+		{"no bad rows", 10, nil},
+		{"first row", 10, []string{"1"}},
+		{"last row", 10, []string{"10"}},
+		{"both edges", 10, []string{"1", "10"}},
+		{"neighbours in the middle", 9, []string{"4", "5"}},
+		{"every row", 4, []string{"1", "2", "3", "4"}},
+		{"single bad row", 1, []string{"1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeCopier{bad: make(map[string]bool)}
+			for _, id := range tt.bad {
+				f.bad[id] = true
+			}
+
+			rejected, err := copyBisecting(f, testRows(tt.rows))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rejectedIds []string
+			for _, row := range rejected {
+				rejectedIds = append(rejectedIds, row.Values[0])
+				if row.RequestId != "request-"+row.Values[0] {
+					t.Fatalf("rejected row %s has request id %s", row.Values[0], row.RequestId)
+				}
+				if row.Err == "" {
+					t.Fatalf("rejected row %s has no error", row.Values[0])
+				}
+			}
+			if !reflect.DeepEqual(rejectedIds, tt.bad) {
+				t.Fatalf("got rejected %v, want %v", rejectedIds, tt.bad)
+			}
+
+			var want []string
+			for _, row := range testRows(tt.rows) {
+				if !f.bad[row.values[0]] {
+					want = append(want, row.values[0])
+				}
+			}
+			if !reflect.DeepEqual(f.imported, want) {
+				t.Fatalf("got imported %v, want %v", f.imported, want)
+			}
+			if len(f.savepoints) != 0 {
+				t.Fatalf("%d savepoints are not released", len(f.savepoints))
+			}
+		})
+	}
+}
+
+// error which isn't caused by data fails the whole import, so the file is retried later
+func TestCopyBisectingConnectionError(t *testing.T) {
+	f := &fakeCopier{err: errors.New("connection reset by peer")}
+
+	rejected, err := copyBisecting(f, testRows(4))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if rejected != nil {
+		t.Fatalf("got rejected rows %v", rejected)
+	}
+}
+
+func TestCopyBisectingEmpty(t *testing.T) {
+	f := &fakeCopier{}
+
+	rejected, err := copyBisecting(f, nil)
+	if err != nil || rejected != nil {
+		t.Fatalf("got %v, %v", rejected, err)
+	}
+	if len(f.savepoints) != 0 {
+		t.Fatal("savepoint is created for empty file")
+	}
+}
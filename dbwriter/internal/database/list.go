@@ -0,0 +1,144 @@
+package database
+
+import (
+	"contract/entities"
+	"dbWriter/internal/common/commonerr"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// sortColumns are columns patients can be sorted by, with type of cursor value
+var sortColumns = map[string]string{
+	"id":            "integer",
+	"last_name":     "text",
+	"date_of_birth": "date",
+}
+
+// cursor points to the last patient of the page, next page starts after it
+type cursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v,omitempty"`
+	Id    uint   `json:"id"`
+}
+
+// ListPatients returns page of patients which match query, pages are found by keyset of sort column and id,
+// so they stay correct while patients are added
+func (r Repository) ListPatients(q entities.PatientQuery) (entities.PatientPage, error) {
+	castType, ok := sortColumns[q.Sort]
+	if !ok {
+		return entities.PatientPage{}, commonerr.Invalid("unknown sort column " + q.Sort)
+	}
+
+	var (
+		conditions []string
+		args       []any
+	)
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if !q.IncludeDeleted {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+	if q.LastName != "" {
+		where("last_name = $%d", q.LastName)
+	}
+	if q.BloodType != 0 {
+		where("blood_type = $%d", q.BloodType)
+	}
+	if q.RhFactor != "" {
+		where("rh_factor = $%d", q.RhFactor)
+	}
+	if q.BornFrom != nil {
+		where("date_of_birth >= $%d", *q.BornFrom)
+	}
+	if q.BornTo != nil {
+		where("date_of_birth <= $%d", *q.BornTo)
+	}
+
+	order := "ASC"
+	compare := ">"
+	if q.Desc {
+		order = "DESC"
+		compare = "<"
+	}
+
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return entities.PatientPage{}, err
+		}
+		if c.Sort != q.Sort || c.Desc != q.Desc {
+			return entities.PatientPage{}, commonerr.Invalid("cursor belongs to another sorting")
+		}
+
+		if q.Sort == "id" {
+			where("id "+compare+" $%d", c.Id)
+		} else {
+			args = append(args, c.Value, c.Id)
+			conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d::%s, $%d)",
+				q.Sort, compare, len(args)-1, castType, len(args)))
+		}
+	}
+
+	query := "SELECT " + returningColumns + " FROM patients"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	//one more patient tells that there is next page
+	args = append(args, q.Limit+1)
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", q.Sort, order, order, len(args))
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return entities.PatientPage{}, fmt.Errorf("failed to list patients: %w", err)
+	}
+	defer rows.Close()
+
+	page := entities.PatientPage{Patients: make([]entities.Patient, 0, q.Limit)}
+	for rows.Next() {
+		patient, err := scanPatient(rows, "failed to read patient")
+		if err != nil {
+			return entities.PatientPage{}, err
+		}
+		page.Patients = append(page.Patients, patient)
+	}
+	if err := rows.Err(); err != nil {
+		return entities.PatientPage{}, fmt.Errorf("failed to list patients: %w", err)
+	}
+
+	if len(page.Patients) > q.Limit {
+		page.Patients = page.Patients[:q.Limit]
+		page.NextCursor = encodeCursor(q, page.Patients[q.Limit-1])
+	}
+
+	return page, nil
+}
+
+func encodeCursor(q entities.PatientQuery, last entities.Patient) string {
+	c := cursor{Sort: q.Sort, Desc: q.Desc, Id: last.Id}
+	switch q.Sort {
+	case "last_name":
+		c.Value = last.LastName
+	case "date_of_birth":
+		c.Value = last.DateOfBirth.String()
+	}
+
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (cursor, error) {
+	var c cursor
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || json.Unmarshal(data, &c) != nil {
+		return cursor{}, commonerr.Invalid("invalid cursor")
+	}
+	return c, nil
+}
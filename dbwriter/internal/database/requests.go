@@ -0,0 +1,149 @@
+package database
+
+import (
+	"contract/entities"
+	"contract/messages"
+	"database/sql"
+	"dbWriter/internal/common/commonerr"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// initRequestStatuses creates table with results of create requests
+func initRequestStatuses(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS request_statuses(
+		request_id TEXT PRIMARY KEY,
+		status TEXT NOT NULL,
+		patient_id INTEGER,
+		error TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMP NOT NULL DEFAULT now());
+		`)
+
+	if err != nil {
+		return fmt.Errorf("failed to create request statuses table: %w", err)
+	}
+	return nil
+}
+
+// SaveRequestStatus saves result of request,
+// request which is handled again after restart overwrites its previous result
+func (r *Repository) SaveRequestStatus(status entities.RequestStatus) error {
+	var patientId sql.NullInt64
+	if status.PatientId != 0 {
+		patientId = sql.NullInt64{Int64: int64(status.PatientId), Valid: true}
+	}
+
+	_, err := r.db.Exec(`
+	INSERT INTO request_statuses(request_id, status, patient_id, error) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (request_id) DO UPDATE
+	SET status = EXCLUDED.status, patient_id = EXCLUDED.patient_id, error = EXCLUDED.error, updated_at = now()`,
+		status.RequestId, status.Status, patientId, status.Err)
+	if err != nil {
+		return fmt.Errorf("failed to save request status: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) FindRequestStatus(requestId string) (entities.RequestStatus, error) {
+	status := entities.RequestStatus{RequestId: requestId}
+	var patientId sql.NullInt64
+
+	err := r.db.QueryRow("SELECT status, patient_id, error FROM request_statuses WHERE request_id = $1", requestId).
+		Scan(&status.Status, &patientId, &status.Err)
+	if errors.Is(err, sql.ErrNoRows) {
+		return entities.RequestStatus{}, commonerr.NotFound(messages.ErrRequestNotExist)
+	}
+	if err != nil {
+		return entities.RequestStatus{}, fmt.Errorf("failed to find request status: %w", err)
+	}
+
+	status.PatientId = uint(patientId.Int64)
+	return status, nil
+}
+
+// FindRequestStatuses finds statuses of requests by one query, requests without status are skipped
+func (r *Repository) FindRequestStatuses(requestIds []string) ([]entities.RequestStatus, error) {
+	rows, err := r.db.Query("SELECT request_id, status, patient_id, error FROM request_statuses WHERE request_id = ANY($1)",
+		pq.Array(requestIds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find request statuses: %w", err)
+	}
+	defer rows.Close()
+
+	var statuses []entities.RequestStatus
+	for rows.Next() {
+		var status entities.RequestStatus
+		var patientId sql.NullInt64
+		if err := rows.Scan(&status.RequestId, &status.Status, &patientId, &status.Err); err != nil {
+			return nil, fmt.Errorf("failed to read request status: %w", err)
+		}
+		status.PatientId = uint(patientId.Int64)
+		statuses = append(statuses, status)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to find request statuses: %w", err)
+	}
+
+	return statuses, nil
+}
+
+// DeleteRequestStatuses deletes statuses which were not changed longer than ttl
+func (r *Repository) DeleteRequestStatuses(ttl time.Duration) (int64, error) {
+	res, err := r.db.Exec("DELETE FROM request_statuses WHERE updated_at < now() - make_interval(secs => $1)", ttl.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete old request statuses: %w", err)
+	}
+
+	deleted, _ := res.RowsAffected()
+	return deleted, nil
+}
+
+// saveImportStatuses saves result of every request which created row of imported file:
+// imported rows succeeded and rejected rows failed. Pending status saved earlier for imported row becomes succeeded,
+// final status is kept, rejected row overwrites it. Statuses of all imported rows are saved by one statement
+func saveImportStatuses(tx *sql.Tx, rows []csvRow, rejected []RejectedRow) error {
+	failed := make(map[string]bool, len(rejected))
+	for _, row := range rejected {
+		if row.RequestId == "" {
+			continue
+		}
+		failed[row.RequestId] = true
+
+		_, err := tx.Exec(`
+		INSERT INTO request_statuses(request_id, status, error) VALUES ($1, $2, $3)
+		ON CONFLICT (request_id) DO UPDATE
+		SET status = EXCLUDED.status, patient_id = NULL, error = EXCLUDED.error, updated_at = now()`,
+			row.RequestId, entities.RequestFailed, fmt.Sprintf("patient was rejected by database: %s", row.Err))
+		if err != nil {
+			return fmt.Errorf("failed to mark request as failed: %w", err)
+		}
+	}
+
+	var requestIds, patientIds []string
+	for _, row := range rows {
+		if row.requestId == "" || failed[row.requestId] {
+			continue
+		}
+		requestIds = append(requestIds, row.requestId)
+		patientIds = append(patientIds, row.values[0])
+	}
+	if len(requestIds) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+	INSERT INTO request_statuses(request_id, status, patient_id)
+	SELECT request_id, $2, patient_id FROM unnest($1::text[], $3::integer[]) AS imported(request_id, patient_id)
+	ON CONFLICT (request_id) DO UPDATE
+	SET status = EXCLUDED.status, patient_id = EXCLUDED.patient_id, error = '', updated_at = now()
+	WHERE request_statuses.status = $4`,
+		pq.Array(requestIds), entities.RequestSucceeded, pq.Array(patientIds), entities.RequestPending)
+	if err != nil {
+		return fmt.Errorf("failed to mark requests as succeeded: %w", err)
+	}
+	return nil
+}
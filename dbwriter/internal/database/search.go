@@ -0,0 +1,67 @@
+package database
+
+import (
+	"contract/entities"
+	"database/sql"
+	"fmt"
+)
+
+// initSearch creates search_key column with name and last name transliterated into lower case latin,
+// so queries in cyrillic and latin are compared in the same alphabet by trigram similarity
+func initSearch(db *sql.DB) error {
+	_, err := db.Exec(`
+	CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+	CREATE OR REPLACE FUNCTION patients_translit(value TEXT) RETURNS TEXT
+	LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+	SELECT translate(
+		replace(replace(replace(replace(replace(replace(replace(replace(replace(replace(replace(replace(replace(
+			lower(value),
+			'щ', 'shch'), 'ш', 'sh'), 'ч', 'ch'), 'ц', 'ts'), 'ж', 'zh'), 'х', 'kh'),
+			'ю', 'yu'), 'я', 'ya'), 'ъ', ''), 'ь', ''),
+			'x', 'ks'), 'w', 'v'), 'ph', 'f'),
+		'абвгдеёзийклмнопрстуфыэ',
+		'abvgdeeziyklmnoprstufye')
+	$$;
+
+	ALTER TABLE patients ADD COLUMN IF NOT EXISTS search_key TEXT
+		GENERATED ALWAYS AS (patients_translit(name || ' ' || last_name)) STORED;
+
+	CREATE INDEX IF NOT EXISTS patients_search_key_idx ON patients USING gin (search_key gin_trgm_ops);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to init patients search: %w", err)
+	}
+	return nil
+}
+
+// SearchPatients finds not deleted patients whose name or last name are similar to query,
+// patients are sorted by similarity
+func (r Repository) SearchPatients(search entities.PatientSearch) (entities.SearchResult, error) {
+	rows, err := r.db.Query(`
+	SELECT `+returningColumns+`, word_similarity(k.key, search_key) AS score
+	FROM patients, patients_translit($1) AS k(key)
+	WHERE deleted_at IS NULL AND k.key <% search_key
+	ORDER BY score DESC, id
+	LIMIT $2`, search.Query, search.Limit)
+	if err != nil {
+		return entities.SearchResult{}, fmt.Errorf("failed to search patients: %w", err)
+	}
+	defer rows.Close()
+
+	result := entities.SearchResult{Matches: make([]entities.PatientMatch, 0)}
+	for rows.Next() {
+		var match entities.PatientMatch
+
+		match.Patient, err = scanPatient(rows, "failed to read found patient", &match.Score)
+		if err != nil {
+			return entities.SearchResult{}, err
+		}
+		result.Matches = append(result.Matches, match)
+	}
+	if err := rows.Err(); err != nil {
+		return entities.SearchResult{}, fmt.Errorf("failed to search patients: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package idalloc
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+type BlockReserver interface {
+	ReserveIdBlock(instanceId string) (start int, size int, err error)
+}
+
+// Block is range of ids [Start, End) reserved by one dbwriter instance
+type Block struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+	Next  int `json:"next"`
+}
+
+// Allocator gives out patient ids from blocks reserved in database,
+// blocks never overlap, so instances and restarts don't produce the same id
+type Allocator struct {
+	mu         sync.Mutex
+	r          BlockReserver
+	instanceId string
+	block      Block
+}
+
+func New(r BlockReserver, instanceId string) *Allocator {
+	return &Allocator{r: r, instanceId: instanceId}
+}
+
+// Next returns next free id, new block is reserved when current one is exhausted
+func (a *Allocator) Next() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.block.Next >= a.block.End {
+		start, size, err := a.r.ReserveIdBlock(a.instanceId)
+		if err != nil {
+			return 0, fmt.Errorf("failed to reserve id block: %w", err)
+		}
+		a.block = Block{Start: start, End: start + size, Next: start}
+		slog.Info("reserved id block", slog.String("instance", a.instanceId),
+			slog.Int("start", a.block.Start), slog.Int("end", a.block.End))
+	}
+
+	id := a.block.Next
+	a.block.Next++
+	return id, nil
+}
+
+// Block returns block which instance is giving ids from
+func (a *Allocator) Block() Block {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.block
+}
@@ -0,0 +1,59 @@
+package kafka
+
+import (
+	"context"
+	"contract/messages"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// expiredReportInterval is how often amount of dropped requests is logged
+const expiredReportInterval = time.Minute
+
+// expired counts requests dropped after their deadline, counters are shared by all partitions
+type expired struct {
+	dropped        atomic.Int64
+	droppedCreates atomic.Int64
+}
+
+// drop tells if nobody waits for reply to the request anymore, such request is counted and must be skipped.
+// Late create is skipped too: requester already answered its client with timeout, so client repeats
+// the request and patient created now would be duplicate. Asynchronous create has no deadline and is always done
+func (e *expired) drop(env messages.Envelope, now time.Time) bool {
+	if !env.Late(now) {
+		return false
+	}
+
+	e.dropped.Add(1)
+	if env.Type == messages.TypeCreatePatient || env.Type == messages.TypeCreatePatients {
+		e.droppedCreates.Add(1)
+	}
+	return true
+}
+
+// report logs amount of dropped requests until ctx is done, nothing is logged while nothing is dropped
+func (e *expired) report(ctx context.Context) {
+	ticker := time.NewTicker(expiredReportInterval)
+	defer ticker.Stop()
+
+	var reported int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		dropped := e.dropped.Load()
+		if dropped == reported {
+			continue
+		}
+		slog.Warn("dropped expired requests",
+			slog.Int64("dropped", dropped-reported),
+			slog.Int64("total", dropped),
+			slog.Int64("totalCreates", e.droppedCreates.Load()))
+		reported = dropped
+	}
+}
@@ -2,12 +2,17 @@ package kafka
 
 import (
 	"context"
+	"contract/entities"
+	"contract/messages"
+	"crypto/sha256"
 	"dbWriter/internal/common/commonerr"
-	"dbWriter/internal/entities"
+	csvwriter "dbWriter/internal/csvWriter"
+	"dbWriter/internal/database"
 	"dbWriter/pkg/sl"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -17,221 +22,1159 @@ import (
 )
 
 type Repository interface {
-	ImportFromCsv(fileName string) error
-	FindBiggestId() (int, error)
-	FindPatient(id int) (entities.Patient, error)
+	ImportFromCsv(filePath string) ([]database.RejectedRow, error)
+	FindPatient(id int, includeDeleted bool) (entities.Patient, error)
+	FindPatients(ids []int, includeDeleted bool) ([]entities.Patient, error)
+	UpdatePatient(update entities.PatientUpdate) (entities.Patient, error)
+	DeletePatient(id int, reason string) (entities.Patient, error)
+	RestorePatient(id int) (entities.Patient, error)
+	ListPatients(q entities.PatientQuery) (entities.PatientPage, error)
+	SearchPatients(search entities.PatientSearch) (entities.SearchResult, error)
+	SaveRequestStatus(status entities.RequestStatus) error
+	FindRequestStatus(requestId string) (entities.RequestStatus, error)
+	FindRequestStatuses(requestIds []string) ([]entities.RequestStatus, error)
+	ClaimIdempotencyKey(key database.IdempotencyKey) (database.IdempotencyKey, bool, error)
+	FindIdempotencyKey(key string) (database.IdempotencyKey, bool, error)
+	ReleaseIdempotencyKey(key string, requestId string) error
+	FindIdOwner(id int) (string, error)
+	ReleaseIdBlocks(instanceId string) error
+}
+
+type IdAllocator interface {
+	Next() (int, error)
 }
 
 type CsvWriter interface {
-	Write(patient entities.Patient, id int) error
-	CreateNewFile()
-	GetFileName() (string, error)
-	GetPathToFile() string
+	Write(patient entities.Patient, id int, requestId string) error
+	Find(id int) (entities.Patient, bool)
+	FindRequest(requestId string) (int, bool)
+	WaitImported(id int) (done <-chan struct{}, inCurrent bool)
+	Rotate() (csvwriter.Batch, error)
+	Orphans() ([]csvwriter.Batch, error)
+	FlushSignal() <-chan struct{}
+	FlushAfter() time.Duration
 }
 
 type Kafka struct {
+	addr     []string
 	producer sarama.AsyncProducer
-	consumer sarama.Consumer
+	client   sarama.Client
+	group    sarama.ConsumerGroup
+
+	//id of this instance, requests for patients with ids it gave out are forwarded to its instance topic
+	instanceId string
+
+	//where to start reading at startup: committed, oldest or newest
+	initialOffset string
+	//encoding of replies, see messages.Marshal
+	encoding string
 }
 
-func New(addr []string) (*Kafka, error) {
+func New(addr []string, groupId string, instanceId string, rebalanceStrategy string, initialOffset string, encoding string) (*Kafka, error) {
+	cfg := sarama.NewConfig()
+	cfg.Consumer.Return.Errors = true
+	//partitions without committed offset are read from the beginning, so nothing produced is lost
+	cfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	switch initialOffset {
+	case "committed", "oldest", "newest":
+	default:
+		return nil, fmt.Errorf("unknown initial offset %s", initialOffset)
+	}
+
+	strategy, err := balanceStrategy(rebalanceStrategy)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{strategy}
+
 	producer, err := sarama.NewAsyncProducer(addr, sarama.NewConfig())
 	if err != nil {
 		return nil, fmt.Errorf("failed to create kafka producer, err: %s", err.Error())
 	}
 
-	consumer, err := sarama.NewConsumer(addr, sarama.NewConfig())
+	client, err := sarama.NewClient(addr, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create kafka consumer, err: %s", err.Error())
+		return nil, fmt.Errorf("failed to create kafka client, err: %s", err.Error())
 	}
 
-	return &Kafka{
-		producer: producer,
-		consumer: consumer,
-	}, nil
+	group, err := sarama.NewConsumerGroupFromClient(groupId, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka consumer group, err: %s", err.Error())
+	}
+
+	k := &Kafka{
+		addr:          addr,
+		producer:      producer,
+		client:        client,
+		group:         group,
+		instanceId:    instanceId,
+		initialOffset: initialOffset,
+		encoding:      encoding,
+	}
+
+	if err := k.createInstanceTopic(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// instanceTopic returns topic where requests are forwarded to the instance
+func instanceTopic(instanceId string) string {
+	return messages.TopicDbwriter + "." + instanceId
 }
 
-func (k Kafka) consumePartition(topic string) (sarama.PartitionConsumer, error) {
-	partitionConsumer, err := k.consumer.ConsumePartition(topic, 0, sarama.OffsetNewest)
+// createInstanceTopic creates topic where only this instance receives forwarded requests
+func (k Kafka) createInstanceTopic() error {
+	admin, err := sarama.NewClusterAdmin(k.addr, sarama.NewConfig())
 	if err != nil {
-		return nil, fmt.Errorf("failed to consume partition, err: %s", err.Error())
+		return fmt.Errorf("failed to create kafka cluster admin: %s", err.Error())
 	}
-	return partitionConsumer, nil
-}
+	defer admin.Close()
 
-func (k Kafka) Start(ctx context.Context, topic string, cr CsvWriter, r Repository) {
-	defer k.consumer.Close()
-	defer k.producer.Close()
+	topic := instanceTopic(k.instanceId)
+	err = admin.CreateTopic(topic, &sarama.TopicDetail{NumPartitions: 1, ReplicationFactor: 1}, false)
+	if err != nil && !errors.Is(err, sarama.ErrTopicAlreadyExists) {
+		return fmt.Errorf("failed to create instance topic %s: %s", topic, err.Error())
+	}
 
-	var mu sync.Mutex
+	return nil
+}
 
-	//finding biggest id in table
-	patientId, err := r.FindBiggestId()
+// deleteInstanceTopic deletes topic of this instance, patients it gave out are imported before it stops,
+// so nothing is forwarded to it anymore
+func (k Kafka) deleteInstanceTopic() error {
+	admin, err := sarama.NewClusterAdmin(k.addr, sarama.NewConfig())
 	if err != nil {
-		slog.Info("failed to get max(id) from psql", sl.Error(err))
+		return fmt.Errorf("failed to create kafka cluster admin: %s", err.Error())
 	}
+	defer admin.Close()
 
-	//consume createPatient partitions
-	createPatientConsumer, err := k.consumePartition(topic)
-	if err != nil {
-		slog.Error("failed to consume partition")
-		os.Exit(1)
+	topic := instanceTopic(k.instanceId)
+	err = admin.DeleteTopic(topic)
+	if err != nil && !errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return fmt.Errorf("failed to delete instance topic %s: %s", topic, err.Error())
 	}
-	defer func() {
-		if err := createPatientConsumer.Close(); err != nil {
-			slog.Error("failed to close partitionConsumer", sl.Error(err))
-		}
-	}()
 
-	//consume patientId partition
-	patientIdConsumer, err := k.consumePartition("patientId")
-	if err != nil {
-		slog.Error("failed to consume patientId partition")
-		os.Exit(1)
+	return nil
+}
+
+func balanceStrategy(name string) (sarama.BalanceStrategy, error) {
+	switch name {
+	case "range":
+		return sarama.NewBalanceStrategyRange(), nil
+	case "roundrobin":
+		return sarama.NewBalanceStrategyRoundRobin(), nil
+	case "sticky", "":
+		return sarama.NewBalanceStrategySticky(), nil
+	default:
+		return nil, fmt.Errorf("unknown rebalance strategy %s", name)
 	}
-	defer func() {
-		if err := patientIdConsumer.Close(); err != nil {
-			slog.Error("failed to close patientId consumer", sl.Error(err))
-		}
-	}()
+}
 
-	//importing data from csv file
-	go func() {
-	loop:
-		for {
-			select {
-			case <-time.After(time.Minute):
-				fileName, err := cr.GetFileName()
+// pauses between failed attempts to join consumer group
+const (
+	minConsumeBackoff = 100 * time.Millisecond
+	maxConsumeBackoff = 30 * time.Second
+)
+
+// groupHandler handles messages from partitions assigned to this dbwriter instance,
+// ConsumeClaim is called in separate gorutine for every partition
+type groupHandler struct {
+	k  Kafka
+	cr CsvWriter
+	r  Repository
+
+	ids IdAllocator
+	l   *loader
+
+	//requests dropped after deadline
+	expired *expired
+
+	//offsets are moved to initialOffset only in the first session after startup
+	resetOffsets *sync.Once
+}
+
+func (h groupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	slog.Info("partitions assigned", slog.Any("claims", session.Claims()))
+
+	var err error
+	h.resetOffsets.Do(func() {
+		err = h.k.moveToInitialOffset(session)
+	})
+	return err
+}
+
+func (h groupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	//commit handled messages before partitions go to another instance
+	session.Commit()
+	slog.Info("partitions revoked", slog.Any("claims", session.Claims()))
+	return nil
+}
+
+// moveToInitialOffset moves offsets of claimed partitions to the oldest or the newest message,
+// with committed initial offset we continue from the last handled message
+func (k Kafka) moveToInitialOffset(session sarama.ConsumerGroupSession) error {
+	if k.initialOffset == "committed" {
+		return nil
+	}
+
+	for topic, partitions := range session.Claims() {
+		for _, partition := range partitions {
+			if k.initialOffset == "oldest" {
+				offset, err := k.client.GetOffset(topic, partition, sarama.OffsetOldest)
 				if err != nil {
-					slog.Error(err.Error())
+					return fmt.Errorf("failed to get oldest offset, err: %s", err.Error())
 				}
+				session.ResetOffset(topic, partition, offset, "")
+				continue
+			}
 
-				mu.Lock()
-				if err := r.ImportFromCsv(fileName); err != nil {
-					slog.Error("faile to import data from csv file", sl.Error(err))
-					continue loop
-				}
-				slog.Info("succesfully import data from csv")
-				cr.CreateNewFile()
-				slog.Info("created file", slog.String("file", fileName))
-				mu.Unlock()
-
-			case <-ctx.Done():
-				slog.Info("closing importing gorutene")
-				return
+			offset, err := k.client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				return fmt.Errorf("failed to get newest offset, err: %s", err.Error())
 			}
+			session.MarkOffset(topic, partition, offset, "")
 		}
-	}()
+	}
 
-	slog.Info("starting to listen kafka")
+	slog.Info("moved offsets", slog.String("initialOffset", k.initialOffset))
+	return nil
+}
 
-infinityLoop:
+func (h groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
 	for {
 		select {
-		//create new patient
-		case msg, ok := <-createPatientConsumer.Messages():
+		case msg, ok := <-claim.Messages():
 			if !ok {
-				slog.Error("Kafka's channels closed ")
-				break infinityLoop
+				return nil
 			}
 
-			var patient entities.Patient
+			h.handle(msg)
 
-			if err := json.Unmarshal(msg.Value, &patient); err != nil {
-				slog.Error("failed to decode msg.Value", sl.Error(err))
-				k.sendError(msg.Key, "failed to unmarshal")
-				continue infinityLoop
-			}
+			//message is handled: patient is flushed to csv file or reply is sent,
+			//so it can be committed and won't be read again after restart
+			session.MarkMessage(msg, "")
 
-			slog.Info("recieved patient", slog.Any("patient", patient))
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
 
-			mu.Lock()
+// handle dispatches request by type of its envelope, every request is answered unless it is late
+func (h groupHandler) handle(msg *sarama.ConsumerMessage) {
+	env, err := readEnvelope(msg)
+	if err != nil {
+		//message of unknown type or newer version is answered, so requester doesn't wait for timeout
+		slog.Error("rejected message", sl.Error(err), slog.String("topic", msg.Topic), slog.String("msgId", string(msg.Key)))
+		h.k.sendError(msg, messages.CodeInternal, err.Error())
+		return
+	}
 
-			err := cr.Write(patient, patientId)
-			if err != nil {
-				slog.Error(err.Error())
-				k.sendError(msg.Key, err.Error())
-				continue infinityLoop
-			}
-			patient.Id = uint(patientId)
-			patientId++
+	//requester stopped waiting for reply, so late request is skipped after backlog without reply
+	if h.expired.drop(env, time.Now()) {
+		return
+	}
 
-			mu.Unlock()
+	switch env.Type {
+	//create new patient
+	case messages.TypeCreatePatient:
+		h.createPatient(msg)
+	//status of create is asked in the topic of the create,
+	//so it is handled only after the create itself
+	case messages.TypeRequestStatus, messages.TypeBatchItemStatus:
+		h.requestStatus(msg)
+	case messages.TypeCreatePatients:
+		h.createPatients(msg)
+	//recieve patient's id and send patient's data
+	case messages.TypeGetPatient:
+		h.findPatient(msg)
+	//send patients by list of ids
+	case messages.TypeGetPatients:
+		h.findPatients(msg)
+	//change patient's fields and send updated patient
+	case messages.TypeUpdatePatient:
+		h.updatePatient(msg)
+	//mark patient as deleted or remove the mark
+	case messages.TypeDeletePatient:
+		h.deletePatient(msg)
+	case messages.TypeRestorePatient:
+		h.restorePatient(msg)
+	//send page of patients
+	case messages.TypeListPatients:
+		h.listPatients(msg)
+	//send patients with similar names
+	case messages.TypeSearchPatients:
+		h.searchPatients(msg)
+	default:
+		slog.Error("unexpected message type", slog.String("type", env.Type))
+		h.k.sendError(msg, messages.CodeInternal, fmt.Sprintf("unexpected message type %q", env.Type))
+	}
+}
 
-			patientData, err := json.Marshal(patient)
-			if err != nil {
-				slog.Error("failed to unmarshal", slog.String("msgId", string(msg.Key)))
-				k.sendError(msg.Key, "failed to unmarshal")
-				continue infinityLoop
-			}
+// consumeForwarded handles requests forwarded to this instance until consumer is closed.
+// Instance topic is read from the newest offset: after restart nobody waits for replies to older requests
+func (h groupHandler) consumeForwarded(consumer sarama.PartitionConsumer) {
+	for msg := range consumer.Messages() {
+		h.handle(msg)
+	}
+}
 
-			k.sendMsg(msg.Key, patientData)
-			fmt.Println("patient send with id = ", patient.Id, " chanId = ", string(msg.Key))
+// forward sends request for patient which is absent in database to running instance which gave out id of the patient,
+// patient created by another instance may still wait for import in its csv file and only that instance has it.
+// False means the request is answered here: it was forwarded already, id is ours or its owner has stopped
+func (h groupHandler) forward(msg *sarama.ConsumerMessage, id int) bool {
+	if header(msg, messages.HeaderForwardedBy) != "" {
+		return false
+	}
 
-		//recieve patient's id and send patient's data
-		case msg, ok := <-patientIdConsumer.Messages():
-			if !ok {
-				slog.Error("Kafka's channels closed ")
-				break infinityLoop
-			}
+	owner, err := h.r.FindIdOwner(id)
+	if err != nil {
+		slog.Error(err.Error(), slog.Int("id", id))
+		return false
+	}
+	if owner == "" || owner == h.k.instanceId {
+		return false
+	}
 
-			idStr := string(msg.Value)
-			id, err := strconv.Atoi(idStr)
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+1)
+	for _, header := range msg.Headers {
+		headers = append(headers, *header)
+	}
+	headers = append(headers, sarama.RecordHeader{Key: []byte(messages.HeaderForwardedBy), Value: []byte(h.k.instanceId)})
 
-			if err != nil || id <= 0 {
-				slog.Error("invalid id")
-				k.sendError(msg.Key, "invalid id")
-				continue infinityLoop
-			}
+	h.k.producer.Input() <- &sarama.ProducerMessage{
+		Topic:   instanceTopic(owner),
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	}
+	return true
+}
+
+// absent tells if patient with the id is not in database even as deleted one,
+// error of the lookup is answered as not found here instead of forwarding
+func (h groupHandler) absent(id int) bool {
+	_, err := h.r.FindPatient(id, true)
+	return commonerr.Code(err) == messages.CodeNotFound
+}
 
-			fmt.Println("id = ", id)
-			patient, err := r.FindPatient(int(id))
-			fmt.Println("patient = ", patient)
+func (h groupHandler) createPatient(msg *sarama.ConsumerMessage) {
+	var patient entities.Patient
 
-			if err != nil {
-				slog.Error(err.Error())
-				k.sendError(msg.Key, err.Error())
-				continue infinityLoop
+	if header(msg, messages.HeaderAsync) == "true" {
+		h.createPatientAsync(msg)
+		return
+	}
+
+	if err := messages.Unmarshal(contentType(msg), msg.Value, &patient); err != nil {
+		slog.Error("failed to decode msg.Value", sl.Error(err))
+		h.k.sendError(msg, messages.CodeValidation, "failed to unmarshal")
+		return
+	}
+
+	slog.Info("recieved patient", slog.Any("patient", patient))
+
+	//invalid patient would be rejected only by import together with the rest of csv file
+	if err := patient.Validate(); err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	//request delivered again after crash gets patient created by the first delivery
+	found, err := h.created(string(msg.Key))
+	if err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+	if first, ok := found[string(msg.Key)]; ok {
+		h.sendPatient(msg, first.patient, first.err)
+		return
+	}
+
+	//request repeated with the same idempotency key gets patient created by the first one
+	first, claimed, err := h.claimKey(msg, patient)
+	if err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+	if !claimed {
+		h.k.sendMsg(msg, first)
+		return
+	}
+	//redelivered request writes patient with id it got at the first delivery
+	patient, patientId := first, int(first.Id)
+
+	if err := h.cr.Write(patient, patientId, string(msg.Key)); err != nil {
+		slog.Error(err.Error())
+		h.releaseKey(msg)
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	h.k.sendMsg(msg, patient)
+	fmt.Println("patient send with id = ", patient.Id, " chanId = ", string(msg.Key))
+}
+
+// createPatientAsync creates patient without reply, result is saved as request status
+// which requester asks later
+func (h groupHandler) createPatientAsync(msg *sarama.ConsumerMessage) {
+	requestId := string(msg.Key)
+	status := entities.RequestStatus{RequestId: requestId, Status: entities.RequestFailed}
+
+	var patient entities.Patient
+	if err := messages.Unmarshal(contentType(msg), msg.Value, &patient); err != nil {
+		slog.Error("failed to decode msg.Value", sl.Error(err))
+		status.Err = "failed to unmarshal"
+		h.saveStatus(status)
+		return
+	}
+
+	if err := patient.Validate(); err != nil {
+		slog.Error(err.Error())
+		status.Err = err.Error()
+		h.saveStatus(status)
+		return
+	}
+
+	//status of request delivered again after crash is already saved by the first delivery or by import
+	found, err := h.created(requestId)
+	if err != nil {
+		slog.Error(err.Error())
+		status.Err = err.Error()
+		h.saveStatus(status)
+		return
+	}
+	if _, ok := found[requestId]; ok {
+		slog.Info("redelivered request is already handled", slog.String("requestId", requestId))
+		return
+	}
+
+	first, claimed, err := h.claimKey(msg, patient)
+	if err != nil {
+		slog.Error(err.Error())
+		status.Err = err.Error()
+		h.saveStatus(status)
+		return
+	}
+	//patient of the first request may still wait for import, status query finds out when it is imported
+	if !claimed {
+		h.saveStatus(entities.RequestStatus{RequestId: requestId, Status: entities.RequestPending, PatientId: first.Id})
+		return
+	}
+	patient, patientId := first, int(first.Id)
+
+	//status is saved before the patient is written, so the request is pending even after crash,
+	//import makes it succeeded or failed as for synchronous create
+	status = entities.RequestStatus{RequestId: requestId, Status: entities.RequestPending, PatientId: uint(patientId)}
+	if !h.saveStatus(status) {
+		h.releaseKey(msg)
+		return
+	}
+
+	//nobody waits for reply, so rejected patient is reported only by its status
+	if err := h.cr.Write(patient, patientId, requestId); err != nil {
+		slog.Error(err.Error())
+		h.releaseKey(msg)
+		h.saveStatus(entities.RequestStatus{RequestId: requestId, Status: entities.RequestFailed, Err: err.Error()})
+	}
+}
+
+// claimKey gives id to the patient and remembers it as response for idempotency key of the request.
+// If the key is already used, patient created by the first request is returned and claimed is false.
+// Used key is looked up before id is given, so repeated requests don't waste ids.
+// Request without the key is always claimed. Patient is kept and compared in JSON,
+// so retry in another encoding is the same request.
+// Request redelivered after restart gets patient it claimed the key with, the patient is claimed again
+// only if the first delivery didn't write it, so it keeps its first id and is never written twice
+func (h groupHandler) claimKey(msg *sarama.ConsumerMessage, patient entities.Patient) (first entities.Patient, claimed bool, err error) {
+	key := header(msg, messages.HeaderIdempotencyKey)
+	if key == "" {
+		return h.giveId(patient)
+	}
+
+	//request is patient without id, id sent by client is replaced anyway
+	patient.Id = 0
+	requestData, err := json.Marshal(patient)
+	if err != nil {
+		return entities.Patient{}, false, fmt.Errorf("failed to encode patient: %w", err)
+	}
+	sum := sha256.Sum256(requestData)
+	requestHash := hex.EncodeToString(sum[:])
+
+	stored, found, err := h.r.FindIdempotencyKey(key)
+	if err != nil {
+		return entities.Patient{}, false, err
+	}
+	if found {
+		return h.firstPatient(msg, key, stored, requestHash)
+	}
+
+	if patient, _, err = h.giveId(patient); err != nil {
+		return entities.Patient{}, false, err
+	}
+	response, err := json.Marshal(patient)
+	if err != nil {
+		return entities.Patient{}, false, fmt.Errorf("failed to encode patient: %w", err)
+	}
+
+	//request with the same key may claim it after the lookup, then its patient is returned
+	stored, claimed, err = h.r.ClaimIdempotencyKey(database.IdempotencyKey{
+		Key:         key,
+		RequestHash: requestHash,
+		RequestId:   string(msg.Key),
+		Response:    response,
+	})
+	if err != nil {
+		return entities.Patient{}, false, err
+	}
+	if claimed {
+		return patient, true, nil
+	}
+	return h.firstPatient(msg, key, stored, requestHash)
+}
+
+// giveId gives next id to the patient
+func (h groupHandler) giveId(patient entities.Patient) (entities.Patient, bool, error) {
+	patientId, err := h.ids.Next()
+	if err != nil {
+		slog.Error(err.Error())
+		return entities.Patient{}, false, commonerr.Unavailable("failed to get patient id")
+	}
+	patient.Id = uint(patientId)
+	return patient, true, nil
+}
+
+// firstPatient returns patient of request which claimed the key, claimed is true for redelivered request
+// whose patient is not written yet
+func (h groupHandler) firstPatient(msg *sarama.ConsumerMessage, key string, stored database.IdempotencyKey, requestHash string) (first entities.Patient, claimed bool, err error) {
+	if stored.RequestHash != requestHash {
+		return entities.Patient{}, false, commonerr.Conflict(messages.ErrIdempotencyKeyReused)
+	}
+
+	if err := json.Unmarshal(stored.Response, &first); err != nil {
+		return entities.Patient{}, false, fmt.Errorf("failed to decode remembered patient: %w", err)
+	}
+
+	if stored.RequestId == string(msg.Key) {
+		written, err := h.written(int(first.Id))
+		if err != nil {
+			return entities.Patient{}, false, err
+		}
+		slog.Info("redelivered request with idempotency key", slog.String("key", key), slog.Bool("written", written))
+		return first, !written, nil
+	}
+
+	slog.Info("repeated request with idempotency key", slog.String("key", key), slog.String("firstRequestId", stored.RequestId))
+	return first, false, nil
+}
+
+// written tells if patient with the id is in csv file or in database
+func (h groupHandler) written(id int) (bool, error) {
+	if _, ok := h.cr.Find(id); ok {
+		return true, nil
+	}
+
+	_, err := h.r.FindPatient(id, true)
+	if commonerr.Code(err) == messages.CodeNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseKey forgets idempotency key of request which failed to create patient
+func (h groupHandler) releaseKey(msg *sarama.ConsumerMessage) {
+	key := header(msg, messages.HeaderIdempotencyKey)
+	if key == "" {
+		return
+	}
+
+	if err := h.r.ReleaseIdempotencyKey(key, string(msg.Key)); err != nil {
+		slog.Error(err.Error(), slog.String("key", key))
+	}
+}
+
+func (h groupHandler) saveStatus(status entities.RequestStatus) bool {
+	if err := h.r.SaveRequestStatus(status); err != nil {
+		slog.Error(err.Error(), slog.String("requestId", status.RequestId))
+		return false
+	}
+	return true
+}
+
+// requestStatus sends status of create request, message value is id of the create request or of row of batch,
+// message key is id of the create message and request id of the envelope is id of the status request.
+// Status of patient which is not imported yet is saved by import, till then the request is pending
+func (h groupHandler) requestStatus(msg *sarama.ConsumerMessage) {
+	requestId := string(msg.Value)
+
+	status, err := h.r.FindRequestStatus(requestId)
+	if commonerr.Code(err) == messages.CodeNotFound {
+		if patientId, ok := h.cr.FindRequest(requestId); ok {
+			status, err = entities.RequestStatus{RequestId: requestId, Status: entities.RequestPending, PatientId: uint(patientId)}, nil
+		}
+	}
+	//request repeated with idempotency key has no row in csv file, so import doesn't change its status,
+	//it succeeds when patient of the first request is imported
+	if err == nil && status.Status == entities.RequestPending && status.PatientId != 0 {
+		if _, ok := h.cr.Find(int(status.PatientId)); !ok {
+			if _, findErr := h.r.FindPatient(int(status.PatientId), true); findErr == nil {
+				status.Status = entities.RequestSucceeded
 			}
+		}
+	}
+	if err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
 
-			patientData, err := json.Marshal(patient)
-			if err != nil {
-				slog.Error(err.Error())
-				k.sendError(msg.Key, err.Error())
-				continue infinityLoop
+	h.k.sendMsg(msg, status)
+}
+
+// createPatients creates every patient of the batch and sends result of each one
+func (h groupHandler) createPatients(msg *sarama.ConsumerMessage) {
+	var patients []entities.Patient
+
+	if err := messages.Unmarshal(contentType(msg), msg.Value, &patients); err != nil {
+		slog.Error("failed to decode msg.Value", sl.Error(err))
+		h.k.sendError(msg, messages.CodeValidation, "failed to unmarshal")
+		return
+	}
+
+	//row of the batch gets its own request id, its status is saved by import
+	requestIds := make([]string, len(patients))
+	for i := range patients {
+		requestIds[i] = fmt.Sprintf("%s.%d", msg.Key, i)
+	}
+
+	//batch delivered again after crash gets rows created by the first delivery
+	found, err := h.created(requestIds...)
+	if err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	results := make([]entities.BatchItemResult, len(patients))
+	for i, patient := range patients {
+		results[i].Index = i
+
+		if err := patient.Validate(); err != nil {
+			responseErr := commonerr.FromError(err)
+			results[i].Code, results[i].Err, results[i].Fields = responseErr.Code, responseErr.Err, responseErr.Fields
+			continue
+		}
+
+		results[i].RequestId = requestIds[i]
+		if first, ok := found[requestIds[i]]; ok {
+			if first.err != nil {
+				results[i].Code, results[i].Err = commonerr.Code(first.err), first.err.Error()
+				continue
 			}
+			results[i].Patient = &first.patient
+			continue
+		}
+
+		patient, err := h.create(patient, results[i].RequestId)
+		if err != nil {
+			slog.Error(err.Error())
+			results[i].Code, results[i].Err = commonerr.Code(err), err.Error()
+			continue
+		}
+		results[i].Patient = &patient
+	}
+
+	h.k.sendMsg(msg, results)
+}
 
-			k.sendMsg(msg.Key, patientData)
+// earlier is result of request handled by earlier delivery, err is set for request which failed
+type earlier struct {
+	patient entities.Patient
+	err     error
+}
 
-			fmt.Println("patient sent")
+// created finds results of requests handled by earlier delivery: dbwriter which crashed after patient was fsynced
+// but before offset was committed gets the request again. Its patient is still in memory of this instance
+// or is imported from orphaned file together with status of the request. Requests which are not found
+// are handled first time
+func (h groupHandler) created(requestIds ...string) (map[string]earlier, error) {
+	found := make(map[string]earlier)
 
-		//exit app and import data into database before exit
-		//if err does not occures we delete csv file
-		case <-ctx.Done():
-			if err := r.ImportFromCsv(cr.GetPathToFile()); err != nil {
-				slog.Error("faield to import data into csv file before closing")
-			} else {
-				os.Remove(cr.GetPathToFile())
+	var unknown []string
+	for _, requestId := range requestIds {
+		if id, ok := h.cr.FindRequest(requestId); ok {
+			if patient, ok := h.cr.Find(id); ok {
+				found[requestId] = earlier{patient: patient}
+				continue
 			}
-			slog.Info("db writer is closing")
+		}
+		unknown = append(unknown, requestId)
+	}
+	if len(unknown) == 0 {
+		return found, nil
+	}
+
+	statuses, err := h.r.FindRequestStatuses(unknown)
+	if err != nil {
+		return nil, err
+	}
+
+	requestsByPatient := make(map[uint]string, len(statuses))
+	var ids []int
+	for _, status := range statuses {
+		switch {
+		case status.Status == entities.RequestFailed:
+			found[status.RequestId] = earlier{err: commonerr.Invalid(status.Err)}
+		case status.PatientId != 0:
+			requestsByPatient[status.PatientId] = status.RequestId
+			ids = append(ids, int(status.PatientId))
+		}
+	}
+	if len(ids) == 0 {
+		return found, nil
+	}
+
+	//patient of status saved before crash may be not written, such request is handled again
+	patients, err := h.r.FindPatients(ids, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, patient := range patients {
+		found[requestsByPatient[patient.Id]] = earlier{patient: patient}
+	}
+	return found, nil
+}
+
+// create gives id to the patient and writes it to csv file
+func (h groupHandler) create(patient entities.Patient, requestId string) (entities.Patient, error) {
+	patientId, err := h.ids.Next()
+	if err != nil {
+		slog.Error(err.Error())
+		return entities.Patient{}, commonerr.Unavailable("failed to get patient id")
+	}
+
+	if err := h.cr.Write(patient, patientId, requestId); err != nil {
+		return entities.Patient{}, err
+	}
+
+	patient.Id = uint(patientId)
+	return patient, nil
+}
+
+func (h groupHandler) findPatient(msg *sarama.ConsumerMessage) {
+	idStr := string(msg.Value)
+	id, err := strconv.Atoi(idStr)
+
+	if err != nil || id <= 0 {
+		slog.Error("invalid id")
+		h.k.sendError(msg, messages.CodeValidation, "invalid id")
+		return
+	}
+
+	fmt.Println("id = ", id)
+
+	//patient created recently may still wait for import
+	includeDeleted := header(msg, messages.HeaderIncludeDeleted) == "true"
+	patient, ok := h.cr.Find(id)
+	if !ok {
+		patient, err = h.r.FindPatient(int(id), includeDeleted)
+	}
+	//deleted patient is in database, so only patient absent in database may be on another instance
+	if commonerr.Code(err) == messages.CodeNotFound && (includeDeleted || h.absent(id)) && h.forward(msg, id) {
+		return
+	}
+	fmt.Println("patient = ", patient)
+
+	if err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	h.k.sendMsg(msg, patient)
+
+	fmt.Println("patient sent")
+}
+
+func (h groupHandler) findPatients(msg *sarama.ConsumerMessage) {
+	var request entities.PatientIds
+
+	if err := messages.Unmarshal(contentType(msg), msg.Value, &request); err != nil || len(request.Ids) == 0 {
+		slog.Error("failed to decode patient ids")
+		h.k.sendError(msg, messages.CodeValidation, "failed to unmarshal")
+		return
+	}
+
+	//patients waiting for import are taken from memory, others from database. Request isn't forwarded,
+	//so patients waiting for import on other instances are not found until they are imported
+	found := make(map[uint]entities.Patient, len(request.Ids))
+	var ids []int
+	for _, id := range request.Ids {
+		if patient, ok := h.cr.Find(int(id)); ok {
+			found[id] = patient
+			continue
+		}
+		ids = append(ids, int(id))
+	}
+
+	if len(ids) > 0 {
+		patients, err := h.r.FindPatients(ids, request.IncludeDeleted)
+		if err != nil {
+			slog.Error(err.Error())
+			h.k.sendErr(msg, err)
 			return
 		}
+
+		for _, patient := range patients {
+			found[patient.Id] = patient
+		}
+	}
+
+	//patients are sent in the same order as ids were requested
+	result := entities.PatientsByIds{Patients: make([]entities.Patient, 0, len(found)), NotFound: make([]uint, 0)}
+	for _, id := range request.Ids {
+		if patient, ok := found[id]; ok {
+			result.Patients = append(result.Patients, patient)
+			continue
+		}
+		result.NotFound = append(result.NotFound, id)
+	}
+
+	h.k.sendMsg(msg, result)
+}
+
+func (h groupHandler) updatePatient(msg *sarama.ConsumerMessage) {
+	var update entities.PatientUpdate
+
+	if err := messages.Unmarshal(contentType(msg), msg.Value, &update); err != nil || update.Id == 0 {
+		slog.Error("failed to decode patient update")
+		h.k.sendError(msg, messages.CodeValidation, "failed to unmarshal")
+		return
+	}
+
+	if err := update.Validate(); err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	//patient from csv file has to reach database before update
+	if err := h.l.waitImported(int(update.Id), 5*time.Second); err != nil {
+		slog.Error(err.Error(), slog.Int("id", int(update.Id)))
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	//deleted patient can't be updated and is not found too, it is answered here
+	patient, err := h.r.UpdatePatient(update)
+	if commonerr.Code(err) == messages.CodeNotFound && h.absent(int(update.Id)) && h.forward(msg, int(update.Id)) {
+		return
+	}
+	h.sendPatient(msg, patient, err)
+}
+
+func (h groupHandler) deletePatient(msg *sarama.ConsumerMessage) {
+	var deletion entities.PatientDeletion
+
+	if err := messages.Unmarshal(contentType(msg), msg.Value, &deletion); err != nil || deletion.Id == 0 {
+		slog.Error("failed to decode patient deletion")
+		h.k.sendError(msg, messages.CodeValidation, "failed to unmarshal")
+		return
+	}
+
+	if err := h.l.waitImported(int(deletion.Id), 5*time.Second); err != nil {
+		slog.Error(err.Error(), slog.Int("id", int(deletion.Id)))
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	//deleted patient is deleted again, so not found patient is absent in database
+	patient, err := h.r.DeletePatient(int(deletion.Id), deletion.Reason)
+	if commonerr.Code(err) == messages.CodeNotFound && h.forward(msg, int(deletion.Id)) {
+		return
+	}
+	h.sendPatient(msg, patient, err)
+}
+
+func (h groupHandler) restorePatient(msg *sarama.ConsumerMessage) {
+	id, err := strconv.Atoi(string(msg.Value))
+	if err != nil || id <= 0 {
+		slog.Error("invalid id")
+		h.k.sendError(msg, messages.CodeValidation, "invalid id")
+		return
+	}
+
+	patient, err := h.r.RestorePatient(id)
+	h.sendPatient(msg, patient, err)
+}
+
+func (h groupHandler) listPatients(msg *sarama.ConsumerMessage) {
+	var query entities.PatientQuery
+
+	if err := messages.Unmarshal(contentType(msg), msg.Value, &query); err != nil || query.Limit <= 0 {
+		slog.Error("failed to decode patient query")
+		h.k.sendError(msg, messages.CodeValidation, "failed to unmarshal")
+		return
+	}
+
+	page, err := h.r.ListPatients(query)
+	if err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	h.k.sendMsg(msg, page)
+}
+
+func (h groupHandler) searchPatients(msg *sarama.ConsumerMessage) {
+	var search entities.PatientSearch
+
+	if err := messages.Unmarshal(contentType(msg), msg.Value, &search); err != nil || search.Query == "" || search.Limit <= 0 {
+		slog.Error("failed to decode patient search")
+		h.k.sendError(msg, messages.CodeValidation, "failed to unmarshal")
+		return
+	}
+
+	result, err := h.r.SearchPatients(search)
+	if err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	h.k.sendMsg(msg, result)
+}
+
+// sendPatient sends patient or error of the operation to requester
+func (h groupHandler) sendPatient(msg *sarama.ConsumerMessage, patient entities.Patient, err error) {
+	if err != nil {
+		slog.Error(err.Error())
+		h.k.sendErr(msg, err)
+		return
+	}
+
+	h.k.sendMsg(msg, patient)
+}
+
+func (k Kafka) Start(ctx context.Context, topic string, cr CsvWriter, r Repository, ids IdAllocator, retry RetryPolicy) {
+	defer k.client.Close()
+	defer k.group.Close()
+	defer k.producer.Close()
+
+	//other instances forward requests for patients this instance gave out, while they are only in its csv file
+	forwarded, err := sarama.NewConsumerFromClient(k.client)
+	if err != nil {
+		slog.Error("failed to create consumer of forwarded requests", sl.Error(err))
+		return
+	}
+	forwardedPartition, err := forwarded.ConsumePartition(instanceTopic(k.instanceId), 0, sarama.OffsetNewest)
+	if err != nil {
+		slog.Error("failed to consume forwarded requests", sl.Error(err))
+		return
+	}
+
+	l := newLoader(cr, r, retry)
+
+	//patients from files left by crashed instance were acknowledged, so they must reach database
+	l.recoverOrphans()
+	//blocks left by crashed run of this instance are not used anymore, their patients are recovered
+	if err := r.ReleaseIdBlocks(k.instanceId); err != nil {
+		slog.Error(err.Error())
+	}
+
+	loaderDone := make(chan struct{})
+	go func() {
+		l.run()
+		close(loaderDone)
+	}()
+
+	rotateCtx, stopRotate := context.WithCancel(ctx)
+	rotateDone := make(chan struct{})
+	go func() {
+		l.rotate(rotateCtx)
+		close(rotateDone)
+	}()
+
+	go func() {
+		for err := range k.group.Errors() {
+			slog.Error("consumer group error", sl.Error(err))
+		}
+	}()
+	go func() {
+		for err := range forwardedPartition.Errors() {
+			slog.Error("forwarded requests consumer error", sl.Error(err))
+		}
+	}()
+
+	exp := &expired{}
+	go exp.report(ctx)
+
+	handler := groupHandler{
+		k:   k,
+		cr:  cr,
+		r:   r,
+		ids: ids,
+		l:   l,
+
+		expired: exp,
+
+		resetOffsets: &sync.Once{},
+	}
+
+	forwardedDone := make(chan struct{})
+	go func() {
+		handler.consumeForwarded(forwardedPartition)
+		close(forwardedDone)
+	}()
+
+	slog.Info("starting to listen kafka")
+
+	topics := []string{topic, messages.TopicCreatePatients, messages.TopicPatientId, messages.TopicPatientIds,
+		messages.TopicUpdatePatient, messages.TopicDeletePatient, messages.TopicRestorePatient,
+		messages.TopicListPatients, messages.TopicSearchPatients}
+
+	//Consume returns after every rebalance, so we join the group again until app is closing.
+	//Failed join is repeated with doubling pause, so unreachable broker doesn't flood the log
+	backoff := minConsumeBackoff
+	for {
+		err := k.group.Consume(ctx, topics, handler)
+		if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			slog.Error("consumer group closed")
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err == nil {
+			backoff = minConsumeBackoff
+			continue
+		}
+
+		slog.Error("failed to consume", sl.Error(err), slog.Duration("retryIn", backoff))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff = min(2*backoff, maxConsumeBackoff)
+	}
+
+	//forwarded requests may wait for import, so they are stopped before the loader
+	forwardedPartition.Close()
+	<-forwardedDone
+	forwarded.Close()
+
+	//exit app and import data into database before exit,
+	//loader imports the last file and all files waiting for import
+	stopRotate()
+	<-rotateDone
+	l.sealCurrent()
+	l.close()
+	<-loaderDone
+
+	//patients of the blocks are imported, so requests for them are not forwarded to stopped instance
+	if err := r.ReleaseIdBlocks(k.instanceId); err != nil {
+		slog.Error(err.Error())
+	}
+	if err := k.deleteInstanceTopic(); err != nil {
+		slog.Error(err.Error())
 	}
+	slog.Info("db writer is closing")
 }
 
-func (k Kafka) sendMsg(key, value []byte) {
+// replyTopic returns topic of server instance which sent the request
+func replyTopic(request *sarama.ConsumerMessage) string {
+	if topic := header(request, messages.HeaderReplyTo); topic != "" {
+		return topic
+	}
+	return messages.TopicPatientInfo
+}
+
+func header(msg *sarama.ConsumerMessage, key string) string {
+	for _, header := range msg.Headers {
+		if string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// contentType returns encoding of request payload from its envelope
+func contentType(msg *sarama.ConsumerMessage) string {
+	if contentType := header(msg, messages.HeaderContentType); contentType != "" {
+		return contentType
+	}
+	return messages.ContentTypeJson
+}
+
+// sendMsg encodes v in encoding of this dbwriter and sends it wrapped into reply
+func (k Kafka) sendMsg(request *sarama.ConsumerMessage, v any) {
+	data, contentType, err := messages.Marshal(k.encoding, v)
+	if err != nil {
+		slog.Error(err.Error())
+		k.sendError(request, messages.CodeInternal, "failed to encode reply")
+		return
+	}
+
+	k.sendTo(replyTopic(request), replyKey(request), contentType, messages.EncodeReply(contentType, data))
+}
+
+// replyKey returns key of reply, it is id of the request from its envelope.
+// It differs from message key for request keyed by another request's id
+func replyKey(request *sarama.ConsumerMessage) []byte {
+	if requestId := header(request, messages.HeaderRequestId); requestId != "" {
+		return []byte(requestId)
+	}
+	return request.Key
+}
+
+// readEnvelope reads envelope of request and checks that its type and version are understood
+func readEnvelope(msg *sarama.ConsumerMessage) (messages.Envelope, error) {
+	env, err := messages.ReadEnvelope(func(key string) string {
+		return header(msg, key)
+	})
+	if err != nil {
+		return env, err
+	}
+	if env.Type == messages.TypeReply {
+		return env, fmt.Errorf("reply is not expected in topic %s", msg.Topic)
+	}
+	return env, env.Check()
+}
+
+// sendTo sends reply with key of the request it answers, the key is request id of reply envelope
+func (k Kafka) sendTo(topic string, key []byte, contentType string, value []byte) {
+	env := messages.NewEnvelope(messages.TypeReply, string(key), messages.SourceDbwriter)
+	env.ContentType = contentType
+
+	var headers []sarama.RecordHeader
+	for name, value := range env.Headers() {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(name), Value: []byte(value)})
+	}
+
 	patientInfoMsg := &sarama.ProducerMessage{
-		Topic: "patientInfo",
-		Key:   sarama.ByteEncoder(key),
-		Value: sarama.ByteEncoder(value),
+		Topic:   topic,
+		Key:     sarama.ByteEncoder(key),
+		Value:   sarama.ByteEncoder(value),
+		Headers: headers,
 	}
 
 	k.producer.Input() <- patientInfoMsg
 }
 
-func (k Kafka) sendError(key []byte, msg string) {
-	err := commonerr.New(msg)
-	errData, _ := json.Marshal(err)
+func (k Kafka) sendError(request *sarama.ConsumerMessage, code string, msg string) {
+	contentType := messages.ContentType(k.encoding)
+	k.sendTo(replyTopic(request), replyKey(request), contentType, messages.EncodeError(contentType, messages.NewError(code, msg)))
+}
 
-	k.sendMsg(key, errData)
+// sendErr sends error with its code, invalid fields of the patient are listed in the reply
+func (k Kafka) sendErr(request *sarama.ConsumerMessage, err error) {
+	contentType := messages.ContentType(k.encoding)
+	k.sendTo(replyTopic(request), replyKey(request), contentType, messages.EncodeError(contentType, commonerr.FromError(err)))
 }
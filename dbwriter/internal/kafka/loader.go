@@ -0,0 +1,199 @@
+package kafka
+
+import (
+	"context"
+	"dbWriter/internal/common/commonerr"
+	csvwriter "dbWriter/internal/csvWriter"
+	"dbWriter/pkg/sl"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// RetryPolicy tells how import of failed file is repeated,
+// backoff is doubled after every attempt
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// pause between imports of files which failed all attempts
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = 5 * time.Minute
+)
+
+// loader imports sealed csv files in background,
+// so writing of new patients continues while previous file is imported
+type loader struct {
+	cr      CsvWriter
+	r       Repository
+	retry   RetryPolicy
+	batches chan csvwriter.Batch
+
+	//files which failed all attempts, they are imported again later.
+	//Only run touches it, recoverOrphans is done before run starts
+	failed []csvwriter.Batch
+}
+
+func newLoader(cr CsvWriter, r Repository, retry RetryPolicy) *loader {
+	return &loader{
+		cr:    cr,
+		r:     r,
+		retry: retry,
+		//if database is slow rotation waits here, writes continue into current file
+		batches: make(chan csvwriter.Batch, 8),
+	}
+}
+
+// rotate seals current file when it is too old, too big or has too many rows
+func (l *loader) rotate(ctx context.Context) {
+	timer := time.NewTimer(l.cr.FlushAfter())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-l.cr.FlushSignal():
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-ctx.Done():
+			slog.Info("closing rotating gorutine")
+			return
+		}
+
+		l.sealCurrent()
+		timer.Reset(l.cr.FlushAfter())
+	}
+}
+
+// sealCurrent switches writer to a new file and passes the sealed one to import
+func (l *loader) sealCurrent() {
+	batch, err := l.cr.Rotate()
+	if err != nil {
+		slog.Error("failed to rotate csv file", sl.Error(err))
+		return
+	}
+
+	if batch.Rows == 0 {
+		batch.Remove()
+		return
+	}
+
+	l.batches <- batch
+}
+
+// run imports sealed files until loader is closed. Files which failed all attempts are imported again
+// with pause doubled after every failed round up to maxRetryInterval, so database which is down for long
+// isn't flooded. Files still failing at close stay locked and are recovered after restart
+func (l *loader) run() {
+	interval := max(l.retry.Backoff, minRetryInterval)
+	retry := time.NewTimer(interval)
+	defer retry.Stop()
+
+	for {
+		select {
+		case batch, ok := <-l.batches:
+			if !ok {
+				l.retryFailed()
+				return
+			}
+			if !l.load(batch) {
+				l.failed = append(l.failed, batch)
+			}
+		case <-retry.C:
+			if l.retryFailed() {
+				interval = max(l.retry.Backoff, minRetryInterval)
+			} else {
+				interval = min(interval*2, maxRetryInterval)
+			}
+			retry.Reset(interval)
+		}
+	}
+}
+
+// retryFailed imports failed files again, it reports if every file is imported
+func (l *loader) retryFailed() bool {
+	if len(l.failed) == 0 {
+		return true
+	}
+
+	var failed []csvwriter.Batch
+	for _, batch := range l.failed {
+		slog.Info("retrying import of csv file", slog.String("file", batch.Path))
+		if !l.load(batch) {
+			failed = append(failed, batch)
+		}
+	}
+	l.failed = failed
+	return len(failed) == 0
+}
+
+// recoverOrphans imports csv files left by crashed dbwriter and deletes them,
+// files which fail to import are retried by run
+func (l *loader) recoverOrphans() {
+	orphans, err := l.cr.Orphans()
+	if err != nil {
+		slog.Error("failed to find orphaned csv files", sl.Error(err))
+		return
+	}
+
+	for _, batch := range orphans {
+		slog.Info("recovering orphaned csv file", slog.String("file", batch.Path), slog.Int("rows", batch.Rows))
+		if !l.load(batch) {
+			l.failed = append(l.failed, batch)
+		}
+	}
+}
+
+// load imports file with retries, rows rejected by database are already quarantined
+// and statuses of their requests are failed. It reports if file is imported, file which still fails stays locked
+func (l *loader) load(batch csvwriter.Batch) bool {
+	backoff := l.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		rejected, err := l.r.ImportFromCsv(batch.Path)
+		if err == nil {
+			if len(rejected) > 0 {
+				slog.Warn("rows are moved to quarantine, their requests are failed",
+					slog.String("file", batch.Path), slog.Int("rows", len(rejected)))
+			}
+			batch.Remove()
+			slog.Info("succesfully import data from csv", slog.String("file", batch.Path), slog.Int("rows", batch.Rows))
+			return true
+		}
+
+		slog.Error("faile to import data from csv file", slog.String("file", batch.Path),
+			slog.Int("attempt", attempt), sl.Error(err))
+		if attempt >= l.retry.Attempts {
+			return false
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// waitImported makes sure patient is in database before it is changed there,
+// file with the patient is rotated if needed
+func (l *loader) waitImported(id int, timeout time.Duration) error {
+	done, inCurrent := l.cr.WaitImported(id)
+	if done == nil {
+		return nil
+	}
+
+	if inCurrent {
+		l.sealCurrent()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return commonerr.Timeout("patient is not imported into database yet, try later")
+	}
+}
+
+func (l *loader) close() {
+	close(l.batches)
+}
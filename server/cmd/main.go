@@ -3,6 +3,7 @@ package main
 import (
 	"HighLoadServer/internal/config"
 	"HighLoadServer/internal/server"
+	"contract/messages"
 	"log/slog"
 	"os"
 )
@@ -22,7 +23,13 @@ func main() {
 		os.Exit(1)
 	}
 
-	serv, err := server.New(cfg.KafkaHost)
+	//dbwriter may reply in protobuf whatever encoding is chosen, so schemas are checked anyway
+	if err := messages.RegisterSchemas(cfg.Schemas.Registry); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	serv, err := server.New(cfg.KafkaHost, cfg.ReplyTopic(), cfg.Kafka.Encoding)
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"contract/messages"
 	"fmt"
 	"os"
 
@@ -8,14 +9,37 @@ import (
 )
 
 type Config struct {
-	Port      string `mapstructure:"port"`
-	KafkaHost string
+	Port       string       `mapstructure:"port"`
+	Kafka      KafkaConfig  `mapstructure:"kafka"`
+	Schemas    SchemaConfig `mapstructure:"schemas"`
+	KafkaHost  string
+	InstanceId string
+}
+
+type KafkaConfig struct {
+	//prefix of the per-instance reply topic, full name is <reply_topic>.<instance id>
+	ReplyTopic string `mapstructure:"reply_topic"`
+	//json or protobuf, payloads without protobuf schema are always json
+	Encoding string `mapstructure:"encoding"`
+}
+
+type SchemaConfig struct {
+	//directory of schema registry shared with dbwriter
+	Registry string `mapstructure:"registry"`
+}
+
+// ReplyTopic returns topic where dbwriter sends replies for this server instance
+func (c Config) ReplyTopic() string {
+	return fmt.Sprintf("%s.%s", c.Kafka.ReplyTopic, c.InstanceId)
 }
 
 func Init(path string) (*Config, error) {
 	var cfg Config
 	v := viper.New()
 	v.SetConfigFile(path)
+	v.SetDefault("kafka.reply_topic", messages.TopicPatientInfo)
+	v.SetDefault("kafka.encoding", messages.EncodingJson)
+	v.SetDefault("schemas.registry", "../schemas")
 	if err := v.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("failed to read config file, path = %s, err = %s", path, err.Error())
 	}
@@ -24,10 +48,24 @@ func Init(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to unmarshal cfg")
 	}
 
+	if err := messages.CheckEncoding(cfg.Kafka.Encoding); err != nil {
+		return nil, err
+	}
+
 	cfg.KafkaHost = os.Getenv("KAFKA_HOST")
 	if cfg.KafkaHost == "" {
 		return nil, fmt.Errorf("failed to read KAFKA_HOST env variable")
 	}
 
+	//every replica needs its own id, container hostname is unique inside docker network
+	cfg.InstanceId = os.Getenv("INSTANCE_ID")
+	if cfg.InstanceId == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read INSTANCE_ID env variable and hostname, err = %s", err.Error())
+		}
+		cfg.InstanceId = hostname
+	}
+
 	return &cfg, nil
 }
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bufio"
+	"contract/entities"
+	"contract/messages"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	maxBatchSize = 1000
+	//patients sent in one kafka message
+	batchChunkSize = 100
+)
+
+// CreatePatients creates patients from JSON array or NDJSON body,
+// result of every patient is returned in the same order as patients were sent
+func (h Handler) CreatePatients() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		items, err := readBatch(ctx)
+		if err != nil {
+			writeProblem(ctx, messages.CodeValidation, err.Error())
+			return
+		}
+
+		if len(items) == 0 || len(items) > maxBatchSize {
+			writeProblem(ctx, messages.CodeValidation, fmt.Sprintf("batch must contain from 1 to %d patients", maxBatchSize))
+			return
+		}
+
+		results := make([]entities.BatchItemResult, len(items))
+
+		//valid patients with their index in the batch
+		var (
+			patients []entities.Patient
+			indexes  []int
+		)
+		for i, item := range items {
+			results[i].Index = i
+
+			var patient entities.Patient
+			if err := json.Unmarshal(item, &patient); err != nil {
+				results[i].Code, results[i].Err = messages.CodeValidation, messages.ErrInvalidPatient
+				if isDateErr(err) {
+					results[i].Fields = dateFields()
+				}
+				continue
+			}
+
+			if err := patient.Validate(); err != nil {
+				results[i].Code, results[i].Err = messages.CodeValidation, messages.ErrInvalidPatient
+				results[i].Fields, _ = err.(entities.ValidationError)
+				continue
+			}
+
+			patients = append(patients, patient)
+			indexes = append(indexes, i)
+		}
+
+		h.sendBatch(patients, indexes, results)
+
+		ctx.JSON(http.StatusOK, gin.H{"results": results})
+	}
+}
+
+// sendBatch sends patients by chunks and writes replies into results
+func (h Handler) sendBatch(patients []entities.Patient, indexes []int, results []entities.BatchItemResult) {
+	type chunk struct {
+		requestId  string
+		indexes    []int
+		responseCh chan *sarama.ConsumerMessage
+	}
+
+	var chunks []chunk
+	for start := 0; start < len(patients); start += batchChunkSize {
+		end := min(start+batchChunkSize, len(patients))
+
+		data, contentType, err := messages.Marshal(h.encoding, patients[start:end])
+		if err != nil {
+			slog.Error("failed to marshal patients", slog.String("err", err.Error()))
+			for _, index := range indexes[start:end] {
+				results[index].Code, results[index].Err = messages.CodeInternal, "failed to send patient"
+			}
+			continue
+		}
+
+		requestId := uuid.New().String()
+		chunks = append(chunks, chunk{
+			requestId:  requestId,
+			indexes:    indexes[start:end],
+			responseCh: h.send(messages.TypeCreatePatients, requestId, contentType, sarama.ByteEncoder(data)),
+		})
+	}
+
+	timeout := time.After(requestTimeout)
+	for _, c := range chunks {
+		var chunkResults []entities.BatchItemResult
+		var chunkErr messages.Error
+
+		select {
+		case msg := <-c.responseCh:
+			env, err := readEnvelope(msg)
+			if err != nil {
+				slog.Error("failed to read reply envelope", slog.String("err", err.Error()))
+				chunkErr = messages.Error{Code: messages.CodeInternal, Err: "unexpected error"}
+				break
+			}
+			responseErr, err := messages.DecodeReply(env.ContentType, msg.Value, &chunkResults)
+			if responseErr != nil {
+				chunkErr = *responseErr
+			} else if err != nil || len(chunkResults) != len(c.indexes) {
+				chunkErr = messages.Error{Code: messages.CodeInternal, Err: "unexpected error"}
+			}
+		case <-timeout:
+			h.responseChan.Delete(c.requestId)
+			chunkErr = messages.Error{Code: messages.CodeTimeout, Err: "failed to get response"}
+		}
+
+		for i, index := range c.indexes {
+			if chunkErr.Err != "" {
+				results[index].Code, results[index].Err = chunkErr.Code, chunkErr.Err
+				continue
+			}
+			results[index].Patient = chunkResults[i].Patient
+			results[index].RequestId = chunkResults[i].RequestId
+			results[index].Code = chunkResults[i].Code
+			results[index].Err = chunkResults[i].Err
+			results[index].Fields = chunkResults[i].Fields
+		}
+	}
+}
+
+// readBatch reads patients from JSON array or, if Content-Type is application/x-ndjson, one patient per line
+func readBatch(ctx *gin.Context) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+
+	if !strings.HasPrefix(ctx.ContentType(), "application/x-ndjson") {
+		if err := json.NewDecoder(ctx.Request.Body).Decode(&items); err != nil {
+			return nil, fmt.Errorf("body must be JSON array of patients")
+		}
+		return items, nil
+	}
+
+	reader := bufio.NewReader(ctx.Request.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			items = append(items, json.RawMessage(line))
+		}
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"contract/entities"
+	"contract/messages"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// DeletePatient marks patient as deleted, reason is read from body or reason query parameter
+func (h Handler) DeletePatient() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, ok := patientId(ctx)
+		if !ok {
+			return
+		}
+
+		deletion := entities.PatientDeletion{Reason: ctx.Query("reason")}
+		if err := ctx.ShouldBindJSON(&deletion); err != nil && !errors.Is(err, io.EOF) {
+			slog.Error("fail to decode request body", slog.String("err", err.Error()))
+			writeProblem(ctx, messages.CodeValidation, "invalid request body")
+			return
+		}
+		deletion.Id = id
+
+		data, contentType, err := messages.Marshal(h.encoding, &deletion)
+		if err != nil {
+			slog.Error("failed to marshal patient deletion", slog.String("err", err.Error()))
+			writeProblem(ctx, messages.CodeInternal, "failed to send deletion")
+			return
+		}
+
+		requestId := uuid.New().String()
+		responseCh := h.send(messages.TypeDeletePatient, requestId, contentType, sarama.ByteEncoder(data))
+
+		h.waitPatient(ctx, requestId, responseCh, http.StatusOK)
+	}
+}
+
+// RestorePatient removes deleted mark from patient
+func (h Handler) RestorePatient() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, ok := patientId(ctx)
+		if !ok {
+			return
+		}
+
+		requestId := uuid.New().String()
+		responseCh := h.send(messages.TypeRestorePatient, requestId, messages.ContentTypeJson, sarama.StringEncoder(strconv.Itoa(int(id))))
+
+		h.waitPatient(ctx, requestId, responseCh, http.StatusOK)
+	}
+}
@@ -1,9 +1,90 @@
 package handlers
 
-type Error struct {
-	Err string `json:"err"`
+import (
+	"contract/entities"
+	"contract/messages"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Problem is error response in RFC 7807 format, code and fields are its extension members
+type Problem struct {
+	Type     string                `json:"type"`
+	Title    string                `json:"title"`
+	Status   int                   `json:"status"`
+	Detail   string                `json:"detail,omitempty"`
+	Instance string                `json:"instance,omitempty"`
+	Code     string                `json:"code"`
+	Fields   []entities.FieldError `json:"fields,omitempty"`
+}
+
+// httpStatus returns HTTP status of error code
+func httpStatus(code string) int {
+	switch code {
+	case messages.CodeNotFound:
+		return http.StatusNotFound
+	case messages.CodeValidation:
+		return http.StatusBadRequest
+	case messages.CodeConflict:
+		return http.StatusConflict
+	case messages.CodeTimeout:
+		return http.StatusGatewayTimeout
+	case messages.CodeUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeProblem aborts request with problem+json response
+func writeProblem(ctx *gin.Context, code string, detail string, fields ...entities.FieldError) {
+	status := httpStatus(code)
+
+	data, _ := json.Marshal(Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: ctx.Request.URL.Path,
+		Code:     code,
+		Fields:   fields,
+	})
+	ctx.Abort()
+	ctx.Data(status, "application/problem+json", data)
+}
+
+// writeErr writes error reply of dbwriter
+func writeErr(ctx *gin.Context, responseErr messages.Error) {
+	writeProblem(ctx, responseErr.Code, responseErr.Err, responseErr.Fields...)
+}
+
+// writeValidationErr writes every invalid field of the patient
+func writeValidationErr(ctx *gin.Context, err error) {
+	var validationErr entities.ValidationError
+	if errors.As(err, &validationErr) {
+		writeProblem(ctx, messages.CodeValidation, messages.ErrInvalidPatient, validationErr...)
+		return
+	}
+	writeProblem(ctx, messages.CodeValidation, err.Error())
+}
+
+// writeBindErr writes error of body which can't be decoded,
+// malformed date of birth is answered as invalid field of the patient
+func writeBindErr(ctx *gin.Context, err error) {
+	if isDateErr(err) {
+		writeProblem(ctx, messages.CodeValidation, messages.ErrInvalidPatient, dateFields()...)
+		return
+	}
+	writeProblem(ctx, messages.CodeValidation, "invalid request body")
+}
+
+func isDateErr(err error) bool {
+	return errors.Is(err, entities.ErrDateFormat)
 }
 
-func NewResponseErr(msg string) Error {
-	return Error{msg}
+func dateFields() []entities.FieldError {
+	return []entities.FieldError{{Field: "date_of_birth", Err: entities.ErrDateFormat.Error()}}
 }
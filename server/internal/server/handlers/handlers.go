@@ -1,8 +1,8 @@
 package handlers
 
 import (
-	"HighLoadServer/internal/entities"
-	"encoding/json"
+	"contract/entities"
+	"contract/messages"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -15,16 +15,73 @@ import (
 	"github.com/google/uuid"
 )
 
+const maxIdempotencyKeyLen = 255
+
 type Handler struct {
 	producer     sarama.AsyncProducer
 	responseChan *sync.Map
+	replyTopic   string
+	//encoding of requests, see messages.Marshal
+	encoding string
 }
 
-func New(producer sarama.AsyncProducer, respChan *sync.Map) Handler {
+func New(producer sarama.AsyncProducer, respChan *sync.Map, replyTopic string, encoding string) Handler {
 	return Handler{
 		producer:     producer,
 		responseChan: respChan,
+		replyTopic:   replyTopic,
+		encoding:     encoding,
+	}
+}
+
+// requestTimeout is how long handler waits for dbwriter's reply, it is the deadline of the request
+const requestTimeout = 10 * time.Second
+
+// send registers channel for the reply and sends request of the type to kafka,
+// dbwriter may skip the request after its deadline
+func (h Handler) send(msgType string, requestId string, contentType string, value sarama.Encoder, headers ...sarama.RecordHeader) chan *sarama.ConsumerMessage {
+	//buffered, so reply router never blocks on request which already timed out
+	responseCh := make(chan *sarama.ConsumerMessage, 1)
+	h.responseChan.Store(requestId, responseCh)
+
+	env := messages.NewEnvelope(msgType, requestId, messages.SourceServer)
+	env.Deadline = env.Timestamp.Add(requestTimeout)
+	env.ContentType = contentType
+	h.post(env, requestId, value, headers...)
+
+	return responseCh
+}
+
+// post sends request to topic of its type without waiting for the reply,
+// envelope goes in headers and reply-to header tells dbwriter which topic this instance is listening to
+func (h Handler) post(env messages.Envelope, key string, value sarama.Encoder, headers ...sarama.RecordHeader) {
+	for name, value := range env.Headers() {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(name), Value: []byte(value)})
+	}
+
+	h.producer.Input() <- &sarama.ProducerMessage{
+		Topic: messages.Topic(env.Type),
+		Key:   sarama.StringEncoder(key),
+		Value: value,
+		Headers: append(headers,
+			sarama.RecordHeader{Key: []byte(messages.HeaderReplyTo), Value: []byte(h.replyTopic)}),
+	}
+}
+
+// readEnvelope reads envelope of dbwriter's reply and checks that its version is understood
+func readEnvelope(msg *sarama.ConsumerMessage) (messages.Envelope, error) {
+	env, err := messages.ReadEnvelope(func(key string) string {
+		for _, header := range msg.Headers {
+			if string(header.Key) == key {
+				return string(header.Value)
+			}
+		}
+		return ""
+	})
+	if err != nil {
+		return env, err
 	}
+	return env, env.Check()
 }
 
 func (h Handler) GetPatient() gin.HandlerFunc {
@@ -34,48 +91,19 @@ func (h Handler) GetPatient() gin.HandlerFunc {
 		idStr := ctx.Param("id")
 
 		if id, err := strconv.Atoi(idStr); err != nil || id <= 0 {
-			ctx.AbortWithStatusJSON(400, gin.H{"err": "invalid patient id"})
+			writeProblem(ctx, messages.CodeValidation, "invalid patient id")
 			return
 		}
 
-		msg := &sarama.ProducerMessage{
-			Topic: "patientId",
-			Key:   sarama.StringEncoder(requestId),
-			Value: sarama.StringEncoder(idStr),
+		//deleted patient is returned only when it is asked explicitly
+		var headers []sarama.RecordHeader
+		if ctx.Query("include_deleted") == "true" {
+			headers = append(headers, sarama.RecordHeader{Key: []byte(messages.HeaderIncludeDeleted), Value: []byte("true")})
 		}
 
-		h.producer.Input() <- msg
-
-		responseCh := make(chan *sarama.ConsumerMessage)
-
-		h.responseChan.Store(requestId, responseCh)
-		fmt.Println("chanId = ", requestId)
-
-		select {
-		case msg := <-responseCh:
-			//implemet different status code
-			h.responseChan.Delete(requestId)
-
-			var patient entities.Patient
-			if err := json.Unmarshal(msg.Value, &patient); err != nil || patient.Id == 0 {
+		responseCh := h.send(messages.TypeGetPatient, requestId, messages.ContentTypeJson, sarama.StringEncoder(idStr), headers...)
 
-				var responseErr Error
-				if err := json.Unmarshal(msg.Value, &responseErr); err != nil || responseErr.Err == "" {
-					ctx.JSON(500, "unexpected error")
-					return
-				}
-
-				ctx.JSON(400, responseErr)
-				return
-			}
-
-			ctx.JSON(200, patient)
-			return
-		case <-time.After(time.Second * 10):
-			h.responseChan.Delete(requestId)
-			ctx.JSON(400, NewResponseErr("failed to get response"))
-			return
-		}
+		h.waitPatient(ctx, requestId, responseCh, http.StatusOK)
 	}
 }
 
@@ -86,65 +114,83 @@ func (h Handler) CreatePatient() gin.HandlerFunc {
 
 		if err := ctx.ShouldBindJSON(&patient); err != nil {
 			slog.Error("fail to decode request body", slog.String("err", err.Error()))
-			ctx.JSON(http.StatusBadRequest, "something goes wrong")
+			writeBindErr(ctx, err)
+			return
+		}
+
+		if err := patient.Validate(); err != nil {
+			writeValidationErr(ctx, err)
 			return
 		}
 
 		//Todo: send data to kafka and return response to client
-		data, err := json.Marshal(&patient)
+		data, contentType, err := messages.Marshal(h.encoding, &patient)
 		if err != nil {
 			slog.Error("failed to marshal patient", slog.String("err", err.Error()))
+			writeProblem(ctx, messages.CodeInternal, "failed to send patient")
+			return
 		}
 
-		msg := &sarama.ProducerMessage{
-			Topic: "createPatient",
-			Key:   sarama.StringEncoder(requestId),
-			Value: sarama.StringEncoder(data),
+		//retry with the same key gets patient created by the first request
+		var headers []sarama.RecordHeader
+		if key := ctx.GetHeader("Idempotency-Key"); key != "" {
+			if len(key) > maxIdempotencyKeyLen {
+				writeProblem(ctx, messages.CodeValidation, "idempotency key is too long")
+				return
+			}
+			headers = append(headers, sarama.RecordHeader{Key: []byte(messages.HeaderIdempotencyKey), Value: []byte(key)})
 		}
 
-		h.producer.Input() <- msg
-
-		responseCh := make(chan *sarama.ConsumerMessage)
+		if isAsync(ctx) {
+			h.createAsync(ctx, requestId, contentType, data, headers...)
+			return
+		}
 
-		h.responseChan.Store(requestId, responseCh)
-		fmt.Println("Send chanId = ", requestId)
+		responseCh := h.send(messages.TypeCreatePatient, requestId, contentType, sarama.ByteEncoder(data), headers...)
 
-		select {
-		case msg := <-responseCh:
-			h.responseChan.Delete(requestId)
-			//implemet different status code
-			var patient entities.Patient
-			if err := json.Unmarshal(msg.Value, &patient); err != nil {
-				slog.Error(err.Error())
+		//patient is imported into database later, if database rejects it status of the request becomes failed
+		ctx.Header("Link", fmt.Sprintf("</requests/%s>; rel=\"status\"", requestId))
 
-				var responseErr Error
-				if err := json.Unmarshal(msg.Value, &responseErr); err != nil || responseErr.Err == "" {
-					ctx.JSON(500, "unexpected error")
-					return
-				}
+		h.waitPatient(ctx, requestId, responseCh, http.StatusCreated)
+	}
+}
 
-				ctx.JSON(400, responseErr)
-				return
-			}
+// waitPatient waits for dbwriter's reply and writes patient or error to client
+func (h Handler) waitPatient(ctx *gin.Context, requestId string, responseCh chan *sarama.ConsumerMessage, status int) {
+	var patient entities.Patient
+	h.waitReply(ctx, requestId, responseCh, status, &patient)
+}
 
-			if patient.Id == 0 {
-				fmt.Print("зашли")
-				var responseErr Error
-				if err := json.Unmarshal(msg.Value, &responseErr); err != nil || responseErr.Err == "" {
-					ctx.JSON(500, "unexpected error")
-					return
-				}
+// waitReply waits for dbwriter's reply, decodes it into reply and writes it or error to client
+func (h Handler) waitReply(ctx *gin.Context, requestId string, responseCh chan *sarama.ConsumerMessage, status int, reply any) {
+	select {
+	case msg := <-responseCh:
+		writeReply(ctx, msg, status, reply)
+	case <-time.After(requestTimeout):
+		h.responseChan.Delete(requestId)
+		writeProblem(ctx, messages.CodeTimeout, "failed to get response")
+	}
+}
 
-				ctx.JSON(400, responseErr)
-				return
-			}
+// writeReply decodes dbwriter's reply into reply and writes it or error to client
+func writeReply(ctx *gin.Context, msg *sarama.ConsumerMessage, status int, reply any) {
+	env, err := readEnvelope(msg)
+	if err != nil {
+		slog.Error("failed to read reply envelope", slog.String("err", err.Error()))
+		writeProblem(ctx, messages.CodeInternal, "unexpected error")
+		return
+	}
 
-			ctx.JSON(201, patient)
-			return
-		case <-time.After(time.Second * 10):
-			ctx.JSON(400, NewResponseErr("failed to get response"))
-			h.responseChan.Delete(requestId)
-			return
-		}
+	responseErr, err := messages.DecodeReply(env.ContentType, msg.Value, reply)
+	if err != nil {
+		slog.Error("failed to decode reply", slog.String("err", err.Error()))
+		writeProblem(ctx, messages.CodeInternal, "unexpected error")
+		return
+	}
+	if responseErr != nil {
+		writeErr(ctx, *responseErr)
+		return
 	}
+
+	ctx.JSON(status, reply)
 }
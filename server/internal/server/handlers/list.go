@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"contract/entities"
+	"contract/messages"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// ListPatients returns page of patients filtered by last_name, blood_type, rh_factor
+// and date of birth range born_from..born_to. Sorting is set by sort=field or sort=-field for descending order.
+// With ids=1,2,3 patients with these ids are returned instead
+func (h Handler) ListPatients() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Query("ids") != "" {
+			h.getPatients(ctx)
+			return
+		}
+
+		query, errMsg := parsePatientQuery(ctx)
+		if errMsg != "" {
+			writeProblem(ctx, messages.CodeValidation, errMsg)
+			return
+		}
+
+		data, contentType, err := messages.Marshal(h.encoding, &query)
+		if err != nil {
+			slog.Error("failed to marshal patient query", slog.String("err", err.Error()))
+			writeProblem(ctx, messages.CodeInternal, "failed to send query")
+			return
+		}
+
+		requestId := uuid.New().String()
+		responseCh := h.send(messages.TypeListPatients, requestId, contentType, sarama.ByteEncoder(data))
+
+		var page entities.PatientPage
+		h.waitReply(ctx, requestId, responseCh, http.StatusOK, &page)
+	}
+}
+
+// getPatients returns patients by list of ids and ids which are not found
+func (h Handler) getPatients(ctx *gin.Context) {
+	request := entities.PatientIds{IncludeDeleted: ctx.Query("include_deleted") == "true"}
+
+	seen := make(map[uint]bool)
+	for _, idStr := range strings.Split(ctx.Query("ids"), ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(idStr))
+		if err != nil || id <= 0 {
+			writeProblem(ctx, messages.CodeValidation, "invalid patient id "+idStr)
+			return
+		}
+		if !seen[uint(id)] {
+			seen[uint(id)] = true
+			request.Ids = append(request.Ids, uint(id))
+		}
+	}
+
+	if len(request.Ids) > maxPageLimit {
+		writeProblem(ctx, messages.CodeValidation, "at most "+strconv.Itoa(maxPageLimit)+" ids are allowed")
+		return
+	}
+
+	data, contentType, err := messages.Marshal(h.encoding, &request)
+	if err != nil {
+		slog.Error("failed to marshal patient ids", slog.String("err", err.Error()))
+		writeProblem(ctx, messages.CodeInternal, "failed to send ids")
+		return
+	}
+
+	requestId := uuid.New().String()
+	responseCh := h.send(messages.TypeGetPatients, requestId, contentType, sarama.ByteEncoder(data))
+
+	var patients entities.PatientsByIds
+	h.waitReply(ctx, requestId, responseCh, http.StatusOK, &patients)
+}
+
+func parsePatientQuery(ctx *gin.Context) (entities.PatientQuery, string) {
+	query := entities.PatientQuery{
+		LastName:       ctx.Query("last_name"),
+		RhFactor:       ctx.Query("rh_factor"),
+		Cursor:         ctx.Query("cursor"),
+		Sort:           "id",
+		Limit:          defaultPageLimit,
+		IncludeDeleted: ctx.Query("include_deleted") == "true",
+	}
+
+	if bloodType := ctx.Query("blood_type"); bloodType != "" {
+		value, err := strconv.Atoi(bloodType)
+		if err != nil || value <= 0 {
+			return query, "invalid blood_type"
+		}
+		query.BloodType = uint(value)
+	}
+
+	var err error
+	if query.BornFrom, err = queryDate(ctx, "born_from"); err != nil {
+		return query, "dates must be in YYYY-MM-DD format"
+	}
+	if query.BornTo, err = queryDate(ctx, "born_to"); err != nil {
+		return query, "dates must be in YYYY-MM-DD format"
+	}
+
+	if sort := ctx.Query("sort"); sort != "" {
+		query.Desc = strings.HasPrefix(sort, "-")
+		query.Sort = strings.TrimPrefix(sort, "-")
+	}
+	switch query.Sort {
+	case "id", "last_name", "date_of_birth":
+	default:
+		return query, "sort must be id, last_name or date_of_birth"
+	}
+
+	if limit := ctx.Query("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 || value > maxPageLimit {
+			return query, "limit must be from 1 to " + strconv.Itoa(maxPageLimit)
+		}
+		query.Limit = value
+	}
+
+	return query, ""
+}
+
+// queryDate reads date from query parameter, missing parameter is nil date
+func queryDate(ctx *gin.Context, param string) (*entities.Date, error) {
+	value := ctx.Query(param)
+	if value == "" {
+		return nil, nil
+	}
+
+	date, err := entities.ParseDate(value)
+	if err != nil {
+		return nil, err
+	}
+	return &date, nil
+}
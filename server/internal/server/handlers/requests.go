@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"contract/entities"
+	"contract/messages"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// status request waits less than other requests, client polls it again anyway
+const statusWaitTimeout = 3 * time.Second
+
+// isAsync tells if client asked to create patient without waiting for the result
+func isAsync(ctx *gin.Context) bool {
+	if ctx.Query("async") == "true" {
+		return true
+	}
+
+	for _, preference := range strings.Split(ctx.GetHeader("Prefer"), ",") {
+		name, _, _ := strings.Cut(preference, ";")
+		if strings.EqualFold(strings.TrimSpace(name), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// createAsync sends patient to dbwriter and answers right away,
+// result of the request is got by its status
+func (h Handler) createAsync(ctx *gin.Context, requestId string, contentType string, data []byte, headers ...sarama.RecordHeader) {
+	//nobody waits for the reply, so the request has no deadline
+	env := messages.NewEnvelope(messages.TypeCreatePatient, requestId, messages.SourceServer)
+	env.ContentType = contentType
+	h.post(env, requestId, sarama.ByteEncoder(data),
+		append(headers, sarama.RecordHeader{Key: []byte(messages.HeaderAsync), Value: []byte("true")})...)
+
+	ctx.Header("Location", "/requests/"+requestId)
+	ctx.Header("Preference-Applied", "respond-async")
+	ctx.JSON(http.StatusAccepted, entities.RequestStatus{RequestId: requestId, Status: entities.RequestPending})
+}
+
+// RequestStatus reports status of create request, row of batch has id <batch request id>.<index>
+func (h Handler) RequestStatus() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestId := ctx.Param("id")
+		createId, index, isRow := strings.Cut(requestId, ".")
+		if _, err := uuid.Parse(createId); err != nil {
+			writeProblem(ctx, messages.CodeValidation, "invalid request id")
+			return
+		}
+		if n, err := strconv.Atoi(index); isRow && (err != nil || n < 0) {
+			writeProblem(ctx, messages.CodeValidation, "invalid request id")
+			return
+		}
+
+		//status request is sent to topic of the create keyed by id of the create message, so it goes
+		//to the same partition and dbwriter handles it after the create. Reply comes with id of the status request
+		msgType := messages.TypeRequestStatus
+		if isRow {
+			msgType = messages.TypeBatchItemStatus
+		}
+		statusRequestId := uuid.New().String()
+		responseCh := make(chan *sarama.ConsumerMessage, 1)
+		h.responseChan.Store(statusRequestId, responseCh)
+
+		env := messages.NewEnvelope(msgType, statusRequestId, messages.SourceServer)
+		env.Deadline = env.Timestamp.Add(statusWaitTimeout)
+		h.post(env, createId, sarama.StringEncoder(requestId))
+
+		select {
+		case msg := <-responseCh:
+			var status entities.RequestStatus
+			writeReply(ctx, msg, http.StatusOK, &status)
+		case <-time.After(statusWaitTimeout):
+			//dbwriter hasn't reached the status request, so it hasn't reached the create either
+			h.responseChan.Delete(statusRequestId)
+			ctx.JSON(http.StatusOK, entities.RequestStatus{RequestId: requestId, Status: entities.RequestPending})
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"contract/entities"
+	"contract/messages"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/IBM/sarama"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// SearchPatients finds patients by name or last name in cyrillic or latin, misspelled names are found too
+func (h Handler) SearchPatients() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		search := entities.PatientSearch{
+			Query: strings.TrimSpace(ctx.Query("q")),
+			Limit: defaultPageLimit,
+		}
+
+		if search.Query == "" {
+			writeProblem(ctx, messages.CodeValidation, "q is required")
+			return
+		}
+
+		if limit := ctx.Query("limit"); limit != "" {
+			value, err := strconv.Atoi(limit)
+			if err != nil || value <= 0 || value > maxPageLimit {
+				writeProblem(ctx, messages.CodeValidation, "limit must be from 1 to "+strconv.Itoa(maxPageLimit))
+				return
+			}
+			search.Limit = value
+		}
+
+		data, contentType, err := messages.Marshal(h.encoding, &search)
+		if err != nil {
+			slog.Error("failed to marshal patient search", slog.String("err", err.Error()))
+			writeProblem(ctx, messages.CodeInternal, "failed to send search")
+			return
+		}
+
+		requestId := uuid.New().String()
+		responseCh := h.send(messages.TypeSearchPatients, requestId, contentType, sarama.ByteEncoder(data))
+
+		var result entities.SearchResult
+		h.waitReply(ctx, requestId, responseCh, http.StatusOK, &result)
+	}
+}
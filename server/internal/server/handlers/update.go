@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"contract/entities"
+	"contract/messages"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/IBM/sarama"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ReplacePatient replaces all fields of the patient
+func (h Handler) ReplacePatient() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, ok := patientId(ctx)
+		if !ok {
+			return
+		}
+
+		var patient entities.Patient
+		if err := ctx.ShouldBindJSON(&patient); err != nil {
+			slog.Error("fail to decode request body", slog.String("err", err.Error()))
+			writeBindErr(ctx, err)
+			return
+		}
+
+		if err := patient.Validate(); err != nil {
+			writeValidationErr(ctx, err)
+			return
+		}
+
+		h.updatePatient(ctx, entities.PatientUpdate{
+			Id:          id,
+			Name:        &patient.Name,
+			LastName:    &patient.LastName,
+			DateOfBirth: &patient.DateOfBirth,
+			BloodType:   &patient.BloodType,
+			RhFactor:    &patient.RhFactor,
+		})
+	}
+}
+
+// ModifyPatient changes only fields which are sent
+func (h Handler) ModifyPatient() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, ok := patientId(ctx)
+		if !ok {
+			return
+		}
+
+		var update entities.PatientUpdate
+		if err := ctx.ShouldBindJSON(&update); err != nil {
+			slog.Error("fail to decode request body", slog.String("err", err.Error()))
+			writeBindErr(ctx, err)
+			return
+		}
+
+		if update.Name == nil && update.LastName == nil && update.DateOfBirth == nil &&
+			update.BloodType == nil && update.RhFactor == nil {
+			writeProblem(ctx, messages.CodeValidation, "nothing to update")
+			return
+		}
+
+		if err := update.Validate(); err != nil {
+			writeValidationErr(ctx, err)
+			return
+		}
+
+		update.Id = id
+		h.updatePatient(ctx, update)
+	}
+}
+
+func (h Handler) updatePatient(ctx *gin.Context, update entities.PatientUpdate) {
+	requestId := uuid.New().String()
+
+	data, contentType, err := messages.Marshal(h.encoding, &update)
+	if err != nil {
+		slog.Error("failed to marshal patient update", slog.String("err", err.Error()))
+		writeProblem(ctx, messages.CodeInternal, "failed to send update")
+		return
+	}
+
+	responseCh := h.send(messages.TypeUpdatePatient, requestId, contentType, sarama.ByteEncoder(data))
+
+	h.waitPatient(ctx, requestId, responseCh, http.StatusOK)
+}
+
+// patientId reads id from path, on invalid id response is written
+func patientId(ctx *gin.Context) (uint, bool) {
+	id, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil || id <= 0 {
+		writeProblem(ctx, messages.CodeValidation, "invalid patient id")
+		return 0, false
+	}
+	return uint(id), true
+}
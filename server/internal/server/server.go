@@ -3,6 +3,8 @@ package server
 import (
 	"HighLoadServer/internal/server/handlers"
 	"context"
+	"contract/messages"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -17,13 +19,21 @@ import (
 )
 
 type Server struct {
-	router   *gin.Engine
-	producer sarama.AsyncProducer
-	consumer sarama.Consumer
+	router     *gin.Engine
+	producer   sarama.AsyncProducer
+	consumer   sarama.Consumer
+	kafkaHost  string
+	replyTopic string
+	encoding   string
 }
 
-func New(kafkaHost string) (*Server, error) {
+func New(kafkaHost string, replyTopic string, encoding string) (*Server, error) {
 	op := "server.New()"
+
+	if err := createReplyTopic(kafkaHost, replyTopic); err != nil {
+		return nil, fmt.Errorf("%s: %s", op, err.Error())
+	}
+
 	producer, err := sarama.NewAsyncProducer([]string{kafkaHost}, sarama.NewConfig())
 	if err != nil {
 		return nil, fmt.Errorf("%s: failed to create kafka producer: %s", op, err.Error())
@@ -35,55 +45,111 @@ func New(kafkaHost string) (*Server, error) {
 	}
 
 	return &Server{
-		router:   gin.Default(),
-		producer: producer,
-		consumer: consumer,
+		router:     gin.Default(),
+		producer:   producer,
+		consumer:   consumer,
+		kafkaHost:  kafkaHost,
+		replyTopic: replyTopic,
+		encoding:   encoding,
 	}, nil
 }
 
+// createReplyTopic creates topic where only this instance receives replies from dbwriter
+func createReplyTopic(kafkaHost string, replyTopic string) error {
+	admin, err := sarama.NewClusterAdmin([]string{kafkaHost}, sarama.NewConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create kafka cluster admin: %s", err.Error())
+	}
+	defer admin.Close()
+
+	err = admin.CreateTopic(replyTopic, &sarama.TopicDetail{NumPartitions: 1, ReplicationFactor: 1}, false)
+	if err != nil && !errors.Is(err, sarama.ErrTopicAlreadyExists) {
+		return fmt.Errorf("failed to create reply topic %s: %s", replyTopic, err.Error())
+	}
+
+	return nil
+}
+
+// deleteReplyTopic deletes reply topic of this instance, nobody else reads it,
+// so topics of replaced containers don't pile up in kafka
+func deleteReplyTopic(kafkaHost string, replyTopic string) error {
+	admin, err := sarama.NewClusterAdmin([]string{kafkaHost}, sarama.NewConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create kafka cluster admin: %s", err.Error())
+	}
+	defer admin.Close()
+
+	err = admin.DeleteTopic(replyTopic)
+	if err != nil && !errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return fmt.Errorf("failed to delete reply topic %s: %s", replyTopic, err.Error())
+	}
+
+	return nil
+}
+
 var responseChannels sync.Map
 
 // var responseChannels map[string]chan *sarama.ConsumerMessage
 // var mu sync.Mutex
 
 func (s *Server) Run(port string) {
+	//deferred first, so it runs after reply consumers and producer are closed
+	defer func() {
+		if err := deleteReplyTopic(s.kafkaHost, s.replyTopic); err != nil {
+			slog.Error(err.Error())
+			return
+		}
+		slog.Info("deleted reply topic", slog.String("topic", s.replyTopic))
+	}()
 	defer s.producer.Close()
 	defer s.consumer.Close()
 
-	patientInfoConsumer, err := s.consumer.ConsumePartition("patientInfo", 0, sarama.OffsetNewest)
+	//reply topic belongs only to this instance, so we read every partition of it
+	partitions, err := s.consumer.Partitions(s.replyTopic)
 	if err != nil {
-		slog.Error("failed to consume patient partition", "err", err)
+		slog.Error("failed to get reply topic partitions", "topic", s.replyTopic, "err", err)
+		os.Exit(1)
 	}
-	defer patientInfoConsumer.Close()
 
-	go func() {
-		for {
-			select {
-			case msg, ok := <-patientInfoConsumer.Messages():
-				if !ok {
-					slog.Info("channel closed, exiting gorutine")
-					return
-				}
-				chanId := string(msg.Key)
-				fmt.Println("Recieved chanId = ", chanId)
-
-				ch, ok := responseChannels.Load(chanId)
-				if ok {
-					ch.(chan *sarama.ConsumerMessage) <- msg
-					responseChannels.Delete(chanId)
-				}
-			}
+	//replies produced before start belong to requests nobody waits for anymore,
+	//so reply topic is always read from the newest offset
+	for _, partition := range partitions {
+		replyConsumer, err := s.consumer.ConsumePartition(s.replyTopic, partition, sarama.OffsetNewest)
+		if err != nil {
+			slog.Error("failed to consume reply partition", "partition", partition, "err", err)
+			os.Exit(1)
 		}
-	}()
+		defer replyConsumer.Close()
+
+		go routeReplies(replyConsumer)
+	}
 
 	//configurate handlers
-	h := handlers.New(s.producer, &responseChannels)
+	h := handlers.New(s.producer, &responseChannels, s.replyTopic, s.encoding)
 
 	//get patient info
 	s.router.GET("/patients/:id", h.GetPatient())
 
+	//get page of patients
+	s.router.GET("/patients", h.ListPatients())
+
+	//find patients by name
+	s.router.GET("/patients/search", h.SearchPatients())
+
 	//create patient
 	s.router.POST("/patients", h.CreatePatient())
+	s.router.POST("/patients/batch", h.CreatePatients())
+
+	//status of asynchronous create
+	s.router.GET("/requests/:id", h.RequestStatus())
+
+	//update patient
+	s.router.PUT("/patients/:id", h.ReplacePatient())
+	s.router.PATCH("/patients/:id", h.ModifyPatient())
+
+	//soft delete and restore patient
+	s.router.DELETE("/patients/:id", h.DeletePatient())
+	s.router.POST("/patients/:id/restore", h.RestorePatient())
 
 	serv := http.Server{
 		Addr:    port,
@@ -93,7 +159,8 @@ func (s *Server) Run(port string) {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 	go func() {
-		if err := serv.ListenAndServe(); err != nil {
+		//Shutdown makes ListenAndServe return ErrServerClosed, it isn't a failure
+		if err := serv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			slog.Error(err.Error())
 			os.Exit(1)
 		}
@@ -113,3 +180,24 @@ func (s *Server) Run(port string) {
 
 	slog.Info("finished server gracefully")
 }
+
+// routeReplies passes replies from dbwriter to handlers waiting for them
+func routeReplies(replyConsumer sarama.PartitionConsumer) {
+	for msg := range replyConsumer.Messages() {
+		//reply carries id of the request it answers in its envelope
+		chanId := string(msg.Key)
+		for _, header := range msg.Headers {
+			if string(header.Key) == messages.HeaderRequestId {
+				chanId = string(header.Value)
+			}
+		}
+
+		ch, ok := responseChannels.LoadAndDelete(chanId)
+		if !ok {
+			slog.Warn("recieved reply nobody waits for", "chanId", chanId, "reply", string(msg.Value))
+			continue
+		}
+		ch.(chan *sarama.ConsumerMessage) <- msg
+	}
+	slog.Info("channel closed, exiting gorutine")
+}